@@ -3,7 +3,11 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/amirhosseinghanipour/nekogo/config"
 	"github.com/amirhosseinghanipour/nekogo/core"
@@ -31,6 +35,8 @@ func init() {
 	configCmd.AddCommand(setActiveCmd)
 	configCmd.AddCommand(clearCmd)
 	configCmd.AddCommand(dedupeCmd)
+	configCmd.AddCommand(setActiveGroupCmd)
+	configCmd.AddCommand(selectCmd)
 }
 
 var startCmd = &cobra.Command{
@@ -50,17 +56,27 @@ var startCmd = &cobra.Command{
 
 		fmt.Printf("Starting NekoGo in %s mode...\n", cfg.Mode)
 		if cfg.Mode == "tun" {
-			if err := core.StartTUNWithConfig(cfg, nil); err != nil {
+			stopChan := make(chan struct{})
+			go func() {
+				sigChan := make(chan os.Signal, 1)
+				signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+				<-sigChan
+				close(stopChan)
+			}()
+			if err := core.StartTUNWithConfig(cfg, stopChan); err != nil {
 				fmt.Printf("Error starting TUN mode: %v\n", err)
 				os.Exit(1)
 			}
 		} else if cfg.Mode == "proxy" {
-			activeServer := cfg.Servers[cfg.ActiveIndex]
-			proxyAddr := fmt.Sprintf("%s:%d", activeServer.Address, activeServer.Port)
-			if err := core.StartProxy(activeServer.Type, proxyAddr); err != nil {
+			proxy, err := core.StartProxy(cfg)
+			if err != nil {
 				fmt.Printf("Error starting proxy mode: %v\n", err)
 				os.Exit(1)
 			}
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+			<-sigChan
+			proxy.Stop()
 		} else {
 			fmt.Printf("Unsupported mode: %s\n", cfg.Mode)
 			os.Exit(1)
@@ -87,14 +103,77 @@ var getCmd = &cobra.Command{
 		}
 		fmt.Printf("Current Mode: %s\n", cfg.Mode)
 		fmt.Printf("Active Server Index: %d\n", cfg.ActiveIndex)
+		if cfg.ActiveGroup != "" {
+			fmt.Printf("Active Group: %s\n", cfg.ActiveGroup)
+		}
 		fmt.Println("Servers:")
 		for i, srv := range cfg.Servers {
 			fmt.Printf("  [%d] %s (%s) - %s:%d\n", i, srv.Name, srv.Type, srv.Address, srv.Port)
 		}
+		fmt.Println("Groups:")
+		for _, g := range cfg.Groups {
+			fmt.Printf("  %s (%s): %s\n", g.Name, g.Type, strings.Join(g.Members, ", "))
+			if g.Type == "selector" && g.Selected != "" {
+				fmt.Printf("    selected: %s\n", g.Selected)
+			}
+		}
+		if cfg.GeoIPPath != "" {
+			fmt.Printf("GeoIP Database: %s\n", cfg.GeoIPPath)
+		}
+		if cfg.GeoSitePath != "" {
+			fmt.Printf("GeoSite Database: %s\n", cfg.GeoSitePath)
+		}
 		fmt.Println("Rules:")
 		for _, rule := range cfg.Rules {
 			fmt.Printf("  - Type: %s, Action: %s, Values: %v\n", rule.Type, rule.Action, rule.Values)
 		}
+		if len(cfg.DNS.Servers) > 0 {
+			fmt.Println("DNS Servers:")
+			for _, s := range cfg.DNS.Servers {
+				detour := s.Detour
+				if detour == "" {
+					detour = "direct"
+				}
+				fmt.Printf("  %s: %s (via %s)\n", s.Name, s.Address, detour)
+			}
+			for _, rule := range cfg.DNS.Rules {
+				fmt.Printf("  - Type: %s, Server: %s, Values: %v\n", rule.Type, rule.Action, rule.Values)
+			}
+			if cfg.DNS.Listen != "" {
+				fmt.Printf("DNS Listen: %s\n", cfg.DNS.Listen)
+			}
+			if cfg.DNS.FakeIP.Enabled {
+				fmt.Printf("Fake IP: %s %s\n", cfg.DNS.FakeIP.IPv4Range(), cfg.DNS.FakeIP.Range6)
+			}
+			if cfg.DNS.Strict {
+				fmt.Println("DNS Hijack: strict")
+			} else if cfg.DNS.HijacksTUN() {
+				fmt.Println("DNS Hijack: on")
+			}
+		}
+		tun := cfg.TUN
+		addr6 := tun.IPv6Address()
+		if addr6 == "" {
+			addr6 = "(no IPv6)"
+		}
+		fmt.Printf("TUN Device: %s %s %s (MTU %d)\n", tun.DeviceName(), tun.IPv4Address(), addr6, tun.DeviceMTU())
+		switch {
+		case !tun.AutoRouteEnabled():
+			fmt.Println("TUN Routing: off")
+		case tun.StrictRoute:
+			fmt.Println("TUN Routing: strict")
+		default:
+			fmt.Println("TUN Routing: on")
+		}
+		if len(tun.IncludeRoutes) > 0 {
+			fmt.Printf("TUN Include Routes: %v\n", tun.IncludeRoutes)
+		}
+		if len(tun.ExcludeRoutes) > 0 {
+			fmt.Printf("TUN Exclude Routes: %v\n", tun.ExcludeRoutes)
+		}
+		if tun.DNS != "" {
+			fmt.Printf("TUN DNS: %s\n", tun.DNS)
+		}
 	},
 }
 
@@ -121,6 +200,7 @@ var setActiveCmd = &cobra.Command{
 		}
 
 		cfg.ActiveIndex = newIndex
+		cfg.ActiveGroup = ""
 		if err := config.SaveConfig("nekogo.yaml", cfg); err != nil {
 			fmt.Printf("Failed to save config: %v\n", err)
 			os.Exit(1)
@@ -129,6 +209,71 @@ var setActiveCmd = &cobra.Command{
 	},
 }
 
+var setActiveGroupCmd = &cobra.Command{
+	Use:   "set-active-group [name]",
+	Short: "Use a group instead of the active server, or stop using one if no name is given",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadConfig("nekogo.yaml")
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+
+		cfg.ActiveGroup = ""
+		if len(args) == 1 {
+			if _, ok := cfg.FindGroup(args[0]); !ok {
+				fmt.Printf("Group %q not found.\n", args[0])
+				os.Exit(1)
+			}
+			cfg.ActiveGroup = args[0]
+		}
+		if err := config.SaveConfig("nekogo.yaml", cfg); err != nil {
+			fmt.Printf("Failed to save config: %v\n", err)
+			os.Exit(1)
+		}
+		if cfg.ActiveGroup == "" {
+			fmt.Println("Active group cleared.")
+		} else {
+			fmt.Printf("Active group set to %s.\n", cfg.ActiveGroup)
+		}
+	},
+}
+
+var selectCmd = &cobra.Command{
+	Use:   "select [group] [member]",
+	Short: "Choose the member a selector group uses",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.LoadConfig("nekogo.yaml")
+		if err != nil {
+			fmt.Printf("Failed to load config: %v\n", err)
+			os.Exit(1)
+		}
+
+		i := slices.IndexFunc(cfg.Groups, func(g config.GroupConfig) bool { return g.Name == args[0] })
+		if i < 0 {
+			fmt.Printf("Group %q not found.\n", args[0])
+			os.Exit(1)
+		}
+		if cfg.Groups[i].Type != "selector" {
+			fmt.Printf("Group %s is a %s group, not a selector.\n", args[0], cfg.Groups[i].Type)
+			os.Exit(1)
+		}
+		if !slices.Contains(cfg.Groups[i].Members, args[1]) {
+			fmt.Printf("Group %s has no member %q.\n", args[0], args[1])
+			os.Exit(1)
+		}
+
+		cfg.Groups[i].Selected = args[1]
+		if err := config.SaveConfig("nekogo.yaml", cfg); err != nil {
+			fmt.Printf("Failed to save config: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Group %s now uses %s.\n", args[0], args[1])
+	},
+}
+
 var clearCmd = &cobra.Command{
 	Use:   "clear",
 	Short: "Remove all servers from the configuration",
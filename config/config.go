@@ -2,30 +2,246 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+
 	"github.com/spf13/viper"
 )
 
 type ServerConfig struct {
-	Name      string `mapstructure:"name"`
-	Type      string `mapstructure:"type"`
-	Address   string `mapstructure:"address"`
-	Port      int    `mapstructure:"port"`
-	UUID      string `mapstructure:"uuid,omitempty"`
-	Password  string `mapstructure:"password,omitempty"`
-	Method    string `mapstructure:"method,omitempty"`
-	Security  string `mapstructure:"security,omitempty"`
-	Network   string `mapstructure:"network,omitempty"`
-	Host      string `mapstructure:"host,omitempty"`
-	Path      string `mapstructure:"path,omitempty"`
-	AlterID   int    `mapstructure:"alterId,omitempty"`
-	TLS       bool   `mapstructure:"tls,omitempty"`
-	Latency   string `mapstructure:"-"` // Latency is tested at runtime, not saved
+	Name          string   `mapstructure:"name"`
+	Type          string   `mapstructure:"type"`
+	Address       string   `mapstructure:"address"`
+	Port          int      `mapstructure:"port"`
+	UUID          string   `mapstructure:"uuid,omitempty"`
+	Username      string   `mapstructure:"username,omitempty"`
+	Password      string   `mapstructure:"password,omitempty"`
+	Method        string   `mapstructure:"method,omitempty"`
+	Security      string   `mapstructure:"security,omitempty"`
+	Network       string   `mapstructure:"network,omitempty"`
+	Host          string   `mapstructure:"host,omitempty"`
+	Path          string   `mapstructure:"path,omitempty"`
+	Flow          string   `mapstructure:"flow,omitempty"` // VLESS: "", "none" or "xtls-rprx-vision", which needs TLS over tcp
+	AlterID       int      `mapstructure:"alterId,omitempty"`
+	TLS           bool     `mapstructure:"tls,omitempty"`
+	SNI           string   `mapstructure:"sni,omitempty"` // TLS server name, if not Host
+	ALPN          []string `mapstructure:"alpn,omitempty"`
+	AllowInsecure bool     `mapstructure:"allowInsecure,omitempty"`
+	CAFile        string   `mapstructure:"caFile,omitempty"`        // PEM bundle to verify the server with instead of the system roots
+	PinSHA256     []string `mapstructure:"pinSHA256,omitempty"`     // SHA-256 of an accepted certificate or public key, in hex or base64
+	TLSMinVersion string   `mapstructure:"tlsMinVersion,omitempty"` // "1.0" to "1.3"
+	Plugin        string   `mapstructure:"plugin,omitempty"`        // SIP003 plugin binary
+	PluginOpts    string   `mapstructure:"pluginOpts,omitempty"`    // SS_PLUGIN_OPTIONS for the plugin
+	Detour        string   `mapstructure:"detour,omitempty"`        // name of the server to connect to this one through
+	Latency       string   `mapstructure:"-"`                       // Latency is tested at runtime, not saved
+}
+
+// GroupConfig is a named group of servers, or of other groups, that picks
+// one member for each connection.
+type GroupConfig struct {
+	Name      string   `mapstructure:"name"`
+	Type      string   `mapstructure:"type"`                // "selector", "url-test", "fallback" or "load-balance"
+	Members   []string `mapstructure:"members"`             // server and group names
+	Selected  string   `mapstructure:"selected,omitempty"`  // selector: the member in use
+	URL       string   `mapstructure:"url,omitempty"`       // health check URL
+	Interval  int      `mapstructure:"interval,omitempty"`  // seconds between health checks
+	Tolerance int      `mapstructure:"tolerance,omitempty"` // url-test: milliseconds a member must be faster by to replace the current one
+	Strategy  string   `mapstructure:"strategy,omitempty"`  // load-balance: "consistent-hashing" (default) or "round-robin"
 }
 
+// RuleConfig routes the connections it matches. Rules are evaluated in
+// order and the first one that matches decides; connections that match no
+// rule go through the active server or group.
 type RuleConfig struct {
-	Type   string   `mapstructure:"type"`
-	Action string   `mapstructure:"action"`
-	Values []string `mapstructure:"values"`
+	Type   string   `mapstructure:"type"`   // see RuleTypes
+	Action string   `mapstructure:"action"` // "proxy", "direct", "block", or the name of a server or group
+	Values []string `mapstructure:"values"` // the rule matches if any value does
+}
+
+// RuleTypes are the supported values of RuleConfig.Type.
+var RuleTypes = []string{
+	"domain",         // exact domain name
+	"domain_suffix",  // domain name or any of its subdomains
+	"domain_keyword", // substring of the domain name
+	"domain_regex",   // regular expression matched against the domain name
+	"ip_cidr",        // destination address prefix
+	"src_ip_cidr",    // source address prefix
+	"dst_port",       // destination port or range such as "8000-9000"
+	"network",        // "tcp" or "udp"
+	"process",        // name or path of the local program that opened the connection
+	"geoip",          // country code of the destination address, looked up in GeoIPPath
+	"geosite",        // category of GeoSitePath, such as "google" or "google@cn"
+	"protocol",       // sniffed protocol: "tls", "http", "quic" or "bittorrent"
+}
+
+// InboundConfig is a local proxy listener used in proxy mode.
+type InboundConfig struct {
+	Type   string `mapstructure:"type"`   // "socks5", "http" or "mixed"
+	Listen string `mapstructure:"listen"` // host:port to listen on
+}
+
+// DefaultInbounds are used in proxy mode when no inbounds are configured.
+var DefaultInbounds = []InboundConfig{
+	{Type: "mixed", Listen: "127.0.0.1:2080"},
+}
+
+// SniffConfig controls protocol sniffing in TUN mode, which looks at the
+// first bytes of each connection to learn its protocol and the domain name
+// it is for, since TUN mode otherwise only sees IP addresses.
+type SniffConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Override dials the sniffed domain instead of the IP address, so that
+	// the server resolves it.
+	Override bool `mapstructure:"override"`
+}
+
+// DNSConfig configures NekoGo's DNS resolver, which the router uses for IP
+// rules and which can serve local clients. It is off if no servers are
+// configured.
+type DNSConfig struct {
+	Servers []DNSServerConfig `mapstructure:"servers"` // upstreams; queries matching no rule go to the first
+	Rules   []RuleConfig      `mapstructure:"rules"`   // domain and geosite rules whose action names a server
+	Hosts   []DNSHostConfig   `mapstructure:"hosts"`   // static answers, checked before any upstream
+	Listen  string            `mapstructure:"listen"`  // host:port to serve DNS on over UDP and TCP, if set
+	FakeIP  FakeIPConfig      `mapstructure:"fake_ip"`
+
+	// Hijack answers every DNS query arriving on the TUN device, whatever
+	// server it was sent to. It is implied by fake-IP and strict mode.
+	Hijack bool `mapstructure:"hijack"`
+	// HijackDoT refuses DNS over TLS and QUIC on port 853 in TUN mode, so
+	// that clients fall back to plain DNS, which is hijacked.
+	HijackDoT bool `mapstructure:"hijack_dot"`
+	// Strict blocks DNS that would leave through a physical interface: it
+	// implies Hijack and HijackDoT, routes the system's resolvers into the
+	// TUN device and requires every server to have a detour other than
+	// "direct".
+	Strict bool `mapstructure:"strict"`
+}
+
+// HijacksTUN reports whether DNS queries on the TUN device are answered by
+// NekoGo.
+func (d DNSConfig) HijacksTUN() bool {
+	return d.Hijack || d.Strict || d.FakeIP.Enabled
+}
+
+// FakeIPConfig configures fake-IP mode. In TUN mode, queries for A and AAAA
+// records are answered with addresses from reserved ranges, and connections
+// to those addresses are dialed by the domain names they stand for.
+type FakeIPConfig struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Range   string   `mapstructure:"range,omitempty"`   // IPv4 pool, DefaultFakeIPRange if empty
+	Range6  string   `mapstructure:"range6,omitempty"`  // IPv6 pool; AAAA queries get no answers if empty
+	Exclude []string `mapstructure:"exclude,omitempty"` // domain suffixes answered with real addresses
+	Store   string   `mapstructure:"store,omitempty"`   // file the mapping is saved to and restored from
+}
+
+// DefaultFakeIPRange is the IPv4 fake-IP pool used if none is configured,
+// the range reserved for benchmarking by RFC 2544.
+const DefaultFakeIPRange = "198.18.0.0/15"
+
+// IPv4Range returns the configured IPv4 pool, or DefaultFakeIPRange.
+func (f FakeIPConfig) IPv4Range() string {
+	if f.Range == "" {
+		return DefaultFakeIPRange
+	}
+	return f.Range
+}
+
+// DNSServerConfig is an upstream DNS server.
+type DNSServerConfig struct {
+	Name string `mapstructure:"name"`
+	// Address is "8.8.8.8" or "udp://8.8.8.8:53" for DNS over UDP,
+	// "tcp://8.8.8.8" for TCP, "tls://1.1.1.1" for DNS over TLS and
+	// "https://1.1.1.1/dns-query" for DNS over HTTPS.
+	Address string `mapstructure:"address"`
+	Detour  string `mapstructure:"detour,omitempty"` // "direct" (default), "proxy", or a server or group name
+}
+
+// DNSHostConfig answers queries for Domain with fixed addresses.
+type DNSHostConfig struct {
+	Domain    string   `mapstructure:"domain"`
+	Addresses []string `mapstructure:"addresses"`
+}
+
+// DNSRuleTypes are the rule types that DNS rules may use.
+var DNSRuleTypes = []string{"domain", "domain_suffix", "domain_keyword", "domain_regex", "geosite"}
+
+// TUNConfig configures the TUN device of TUN mode. Fields left empty take
+// the defaults below.
+type TUNConfig struct {
+	Name     string `mapstructure:"name,omitempty"`     // device name, DefaultTUNName if empty; macOS only accepts utun0, utun1...
+	Address  string `mapstructure:"address,omitempty"`  // IPv4 address and prefix of the device, DefaultTUNAddress if empty
+	Address6 string `mapstructure:"address6,omitempty"` // IPv6 address and prefix, DefaultTUNAddress6 if empty or TUNAddressNone for no IPv6
+	MTU      int    `mapstructure:"mtu,omitempty"`      // DefaultTUNMTU if 0
+	// AutoRoute routes traffic into the device and around it for the
+	// servers and the LAN. It is on unless set to false, in which case the
+	// device only gets its addresses.
+	AutoRoute *bool `mapstructure:"auto_route,omitempty"`
+	// StrictRoute routes the LAN into the device as well, leaving only the
+	// servers, ExcludeRoutes and NekoGo's own connections outside it.
+	StrictRoute   bool     `mapstructure:"strict_route,omitempty"`
+	IncludeRoutes []string `mapstructure:"include_routes,omitempty"` // prefixes routed into the device; all traffic if empty
+	ExcludeRoutes []string `mapstructure:"exclude_routes,omitempty"` // prefixes routed around the device
+	// DNS is the DNS server of the device on Windows. It defaults to the
+	// DNS listener if there is one, or 8.8.8.8.
+	DNS string `mapstructure:"dns,omitempty"`
+}
+
+// The TUN device settings used if none are configured.
+const (
+	DefaultTUNName     = "nekogo-tun"
+	DefaultTUNAddress  = "10.0.85.2/24"
+	DefaultTUNAddress6 = "fdfe:dcba:9876::2/64"
+	DefaultTUNMTU      = 1500
+)
+
+// TUNAddressNone as the IPv6 address leaves IPv6 out of TUN mode, for hosts
+// that have it turned off.
+const TUNAddressNone = "none"
+
+// DeviceName returns the configured device name, or DefaultTUNName.
+func (t TUNConfig) DeviceName() string {
+	if t.Name == "" {
+		return DefaultTUNName
+	}
+	return t.Name
+}
+
+// IPv4Address returns the configured IPv4 prefix, or DefaultTUNAddress.
+func (t TUNConfig) IPv4Address() string {
+	if t.Address == "" {
+		return DefaultTUNAddress
+	}
+	return t.Address
+}
+
+// IPv6Address returns the configured IPv6 prefix, or DefaultTUNAddress6.
+// It returns "" if IPv6 is turned off.
+func (t TUNConfig) IPv6Address() string {
+	switch t.Address6 {
+	case "":
+		return DefaultTUNAddress6
+	case TUNAddressNone:
+		return ""
+	}
+	return t.Address6
+}
+
+// DeviceMTU returns the configured MTU, or DefaultTUNMTU.
+func (t TUNConfig) DeviceMTU() int {
+	if t.MTU == 0 {
+		return DefaultTUNMTU
+	}
+	return t.MTU
+}
+
+// AutoRouteEnabled reports whether AutoRoute is on.
+func (t TUNConfig) AutoRouteEnabled() bool {
+	return t.AutoRoute == nil || *t.AutoRoute
 }
 
 type SubscriptionConfig struct {
@@ -39,6 +255,14 @@ type AppConfig struct {
 	Rules         []RuleConfig         `mapstructure:"rules"`
 	Subscriptions []SubscriptionConfig `mapstructure:"subscriptions"`
 	ActiveIndex   int                  `mapstructure:"active_index"`
+	ActiveGroup   string               `mapstructure:"active_group"` // used instead of the active server if set
+	Groups        []GroupConfig        `mapstructure:"groups"`
+	Inbounds      []InboundConfig      `mapstructure:"inbounds"`
+	GeoIPPath     string               `mapstructure:"geoip_path"`   // MaxMind DB (mmdb) file for geoip rules
+	GeoSitePath   string               `mapstructure:"geosite_path"` // v2ray geosite.dat file for geosite rules
+	Sniff         SniffConfig          `mapstructure:"sniff"`
+	DNS           DNSConfig            `mapstructure:"dns"`
+	TUN           TUNConfig            `mapstructure:"tun"`
 }
 
 func LoadConfig(path string) (*AppConfig, error) {
@@ -62,9 +286,68 @@ func SaveConfig(path string, cfg *AppConfig) error {
 	viper.Set("rules", cfg.Rules)
 	viper.Set("subscriptions", cfg.Subscriptions)
 	viper.Set("active_index", cfg.ActiveIndex)
+	viper.Set("active_group", cfg.ActiveGroup)
+	viper.Set("groups", cfg.Groups)
+	viper.Set("inbounds", cfg.Inbounds)
+	viper.Set("geoip_path", cfg.GeoIPPath)
+	viper.Set("geosite_path", cfg.GeoSitePath)
+	viper.Set("sniff", cfg.Sniff)
+	viper.Set("dns", settingsMap(cfg.DNS))
+	viper.Set("tun", settingsMap(cfg.TUN))
 	return viper.WriteConfigAs(path) // Use WriteConfigAs to create the file if it doesn't exist
 }
 
+// settingsMap returns v with its structs turned into maps keyed by their
+// mapstructure tags, which LoadConfig reads. viper would otherwise write
+// structs under their lowercased field names, losing every field whose tag
+// differs, such as auto_route. Fields tagged omitempty are left out when
+// they are zero.
+func settingsMap(v any) any {
+	return settingsValue(reflect.ValueOf(v))
+}
+
+func settingsValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return settingsValue(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]any)
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			fv := v.Field(i)
+			if fv.IsZero() && (strings.Contains(opts, "omitempty") || fv.Kind() == reflect.Pointer) {
+				continue
+			}
+			m[name] = settingsValue(fv)
+		}
+		return m
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		s := make([]any, v.Len())
+		for i := range s {
+			s[i] = settingsValue(v.Index(i))
+		}
+		return s
+	default:
+		return v.Interface()
+	}
+}
+
 func (cfg *AppConfig) Validate() error {
 	if len(cfg.Servers) == 0 {
 		return fmt.Errorf("no servers configured")
@@ -72,5 +355,402 @@ func (cfg *AppConfig) Validate() error {
 	if cfg.ActiveIndex < 0 || cfg.ActiveIndex >= len(cfg.Servers) {
 		return fmt.Errorf("invalid active server index")
 	}
+	listening := make(map[string]bool)
+	for _, in := range cfg.Inbounds {
+		switch in.Type {
+		case "socks5", "http", "mixed":
+		default:
+			return fmt.Errorf("unsupported inbound type: %s", in.Type)
+		}
+		if _, _, err := net.SplitHostPort(in.Listen); err != nil {
+			return fmt.Errorf("invalid listen address for %s inbound: %w", in.Type, err)
+		}
+		if listening[in.Listen] {
+			return fmt.Errorf("duplicate inbound listen address: %s", in.Listen)
+		}
+		listening[in.Listen] = true
+	}
+	for i, server := range cfg.Servers {
+		if server.Detour == "" {
+			continue
+		}
+		if _, err := cfg.DetourChain(i); err != nil {
+			return err
+		}
+	}
+	if err := cfg.validateGroups(); err != nil {
+		return err
+	}
+	if err := cfg.validateRules(); err != nil {
+		return err
+	}
+	if err := cfg.validateDNS(); err != nil {
+		return err
+	}
+	if err := cfg.TUN.Validate(); err != nil {
+		return err
+	}
+	if cfg.ActiveGroup != "" {
+		if _, ok := cfg.FindGroup(cfg.ActiveGroup); !ok {
+			return fmt.Errorf("active group %q not found", cfg.ActiveGroup)
+		}
+	}
+	return nil
+}
+
+func (cfg *AppConfig) validateGroups() error {
+	names := make(map[string]bool)
+	for _, g := range cfg.Groups {
+		if g.Name == "" {
+			return fmt.Errorf("group without a name")
+		}
+		if names[g.Name] {
+			return fmt.Errorf("duplicate group name: %s", g.Name)
+		}
+		if _, ok := cfg.FindServer(g.Name); ok {
+			return fmt.Errorf("group %s has the same name as a server", g.Name)
+		}
+		names[g.Name] = true
+		switch g.Type {
+		case "selector", "url-test", "fallback", "load-balance":
+		default:
+			return fmt.Errorf("group %s: unsupported type: %s", g.Name, g.Type)
+		}
+		switch g.Strategy {
+		case "", "consistent-hashing", "round-robin":
+		default:
+			return fmt.Errorf("group %s: unsupported strategy: %s", g.Name, g.Strategy)
+		}
+		if len(g.Members) == 0 {
+			return fmt.Errorf("group %s has no members", g.Name)
+		}
+		if g.Interval < 0 || g.Tolerance < 0 {
+			return fmt.Errorf("group %s: interval and tolerance must not be negative", g.Name)
+		}
+		if g.Selected != "" && !slices.Contains(g.Members, g.Selected) {
+			return fmt.Errorf("group %s: selected %q is not a member", g.Name, g.Selected)
+		}
+	}
+	for _, g := range cfg.Groups {
+		for _, m := range g.Members {
+			_, isServer := cfg.FindServer(m)
+			if !isServer && !names[m] {
+				return fmt.Errorf("group %s: no server or group named %q", g.Name, m)
+			}
+		}
+		if err := cfg.checkGroupLoop(g, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *AppConfig) validateRules() error {
+	for i, r := range cfg.Rules {
+		if !slices.Contains(RuleTypes, r.Type) {
+			return fmt.Errorf("rule %d: unsupported type: %s", i+1, r.Type)
+		}
+		if err := cfg.validateRuleValues(r); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		if !cfg.validOutbound(r.Action, true) {
+			return fmt.Errorf("rule %d: unknown action %q: not proxy, direct, block or a server or group name", i+1, r.Action)
+		}
+	}
+	return nil
+}
+
+func (cfg *AppConfig) validateRuleValues(r RuleConfig) error {
+	if len(r.Values) == 0 {
+		return fmt.Errorf("no values")
+	}
+	if r.Type == "geoip" && cfg.GeoIPPath == "" {
+		return fmt.Errorf("geoip rules need geoip_path")
+	}
+	if r.Type == "geosite" && cfg.GeoSitePath == "" {
+		return fmt.Errorf("geosite rules need geosite_path")
+	}
+	return nil
+}
+
+// validOutbound reports whether name is "proxy", "direct", a server or a
+// group, or "block" if allowed.
+func (cfg *AppConfig) validOutbound(name string, allowBlock bool) bool {
+	switch name {
+	case "proxy", "direct":
+		return true
+	case "block":
+		return allowBlock
+	}
+	_, isServer := cfg.FindServer(name)
+	_, isGroup := cfg.FindGroup(name)
+	return isServer || isGroup
+}
+
+func (cfg *AppConfig) validateDNS() error {
+	dns := cfg.DNS
+	if len(dns.Servers) == 0 {
+		if dns.Listen != "" || len(dns.Rules) > 0 || dns.HijacksTUN() {
+			return fmt.Errorf("dns: no servers configured")
+		}
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, s := range dns.Servers {
+		if s.Name == "" {
+			return fmt.Errorf("dns: server without a name")
+		}
+		if names[s.Name] {
+			return fmt.Errorf("dns: duplicate server name: %s", s.Name)
+		}
+		names[s.Name] = true
+		if _, _, err := ParseDNSAddress(s.Address); err != nil {
+			return fmt.Errorf("dns server %s: %w", s.Name, err)
+		}
+		if s.Detour != "" && !cfg.validOutbound(s.Detour, false) {
+			return fmt.Errorf("dns server %s: unknown detour %q", s.Name, s.Detour)
+		}
+		if dns.Strict && (s.Detour == "" || s.Detour == "direct") {
+			return fmt.Errorf("dns server %s: strict mode needs a detour other than direct", s.Name)
+		}
+	}
+	for i, r := range dns.Rules {
+		if !slices.Contains(DNSRuleTypes, r.Type) {
+			return fmt.Errorf("dns rule %d: unsupported type: %s", i+1, r.Type)
+		}
+		if err := cfg.validateRuleValues(r); err != nil {
+			return fmt.Errorf("dns rule %d: %w", i+1, err)
+		}
+		if !names[r.Action] {
+			return fmt.Errorf("dns rule %d: no dns server named %q", i+1, r.Action)
+		}
+	}
+	for _, h := range dns.Hosts {
+		if h.Domain == "" || len(h.Addresses) == 0 {
+			return fmt.Errorf("dns: hosts entries need a domain and addresses")
+		}
+		for _, a := range h.Addresses {
+			if net.ParseIP(a) == nil {
+				return fmt.Errorf("dns: invalid address for %s: %s", h.Domain, a)
+			}
+		}
+	}
+	if dns.Listen != "" {
+		if _, _, err := net.SplitHostPort(dns.Listen); err != nil {
+			return fmt.Errorf("dns: invalid listen address: %w", err)
+		}
+	}
+	if dns.FakeIP.Enabled {
+		if err := validateFakeIPRange(dns.FakeIP.IPv4Range(), false); err != nil {
+			return err
+		}
+		if dns.FakeIP.Range6 != "" {
+			if err := validateFakeIPRange(dns.FakeIP.Range6, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// minTUNMTU is the smallest MTU IPv6 allows.
+const minTUNMTU = 1280
+
+// Validate checks the TUN settings, which AppConfig.Validate does as well.
+func (tun TUNConfig) Validate() error {
+	if strings.ContainsAny(tun.DeviceName(), " /\\") || len(tun.DeviceName()) > 15 {
+		return fmt.Errorf("tun: invalid device name: %q", tun.Name)
+	}
+	if err := validateTUNAddress(tun.IPv4Address(), false); err != nil {
+		return err
+	}
+	if addr6 := tun.IPv6Address(); addr6 != "" {
+		if err := validateTUNAddress(addr6, true); err != nil {
+			return err
+		}
+	}
+	if mtu := tun.DeviceMTU(); mtu < minTUNMTU || mtu > 65535 {
+		return fmt.Errorf("tun: MTU %d is not between %d and 65535", mtu, minTUNMTU)
+	}
+	for _, routes := range [][]string{tun.IncludeRoutes, tun.ExcludeRoutes} {
+		for _, r := range routes {
+			p, err := netip.ParsePrefix(r)
+			if err != nil {
+				return fmt.Errorf("tun: invalid route: %w", err)
+			}
+			if p != p.Masked() {
+				return fmt.Errorf("tun: route %s has host bits set, use %s", r, p.Masked())
+			}
+		}
+	}
+	if tun.IPv6Address() == "" {
+		for _, r := range tun.IncludeRoutes {
+			if netip.MustParsePrefix(r).Addr().Is6() {
+				return fmt.Errorf("tun: include route %s needs an IPv6 address", r)
+			}
+		}
+	}
+	if tun.DNS != "" {
+		if _, err := netip.ParseAddr(tun.DNS); err != nil {
+			return fmt.Errorf("tun: invalid DNS server: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateTUNAddress checks that an address of the TUN device is a host
+// address of the given family with the length of its network.
+func validateTUNAddress(cidr string, ipv6 bool) error {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("tun: invalid address: %w", err)
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	if p.Addr().Is6() != ipv6 || p.Addr().Is4In6() {
+		return fmt.Errorf("tun: address %s is not an %s prefix", cidr, family)
+	}
+	if p.Addr() == p.Masked().Addr() || p.Bits() == p.Addr().BitLen() {
+		return fmt.Errorf("tun: address %s needs a host address and a shorter prefix", cidr)
+	}
+	return nil
+}
+
+// validateFakeIPRange checks that a fake-IP pool is a prefix of the given
+// family with room for at least a few hundred names.
+func validateFakeIPRange(cidr string, ipv6 bool) error {
+	p, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("dns: invalid fake-IP range: %w", err)
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	if p.Addr().Is6() != ipv6 || p.Addr().Is4In6() {
+		return fmt.Errorf("dns: fake-IP range %s is not an %s prefix", cidr, family)
+	}
+	if p.Addr().BitLen()-p.Bits() < 8 {
+		return fmt.Errorf("dns: fake-IP range %s is too small", cidr)
+	}
+	return nil
+}
+
+// ParseDNSAddress splits the address of a DNS server into its transport,
+// "udp", "tcp", "tls" or "https", and the rest: host:port for the first
+// three, with the default port added, and the URL for "https".
+func ParseDNSAddress(addr string) (transport, target string, err error) {
+	transport, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		transport, rest = "udp", addr
+	}
+	var port string
+	switch transport {
+	case "udp", "tcp":
+		port = "53"
+	case "tls":
+		port = "853"
+	case "https":
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" {
+			return "", "", fmt.Errorf("invalid DNS over HTTPS URL: %s", addr)
+		}
+		return transport, addr, nil
+	default:
+		return "", "", fmt.Errorf("unsupported DNS transport: %s", transport)
+	}
+	if rest == "" {
+		return "", "", fmt.Errorf("invalid DNS server address: %s", addr)
+	}
+	if _, _, err := net.SplitHostPort(rest); err != nil {
+		rest = net.JoinHostPort(strings.Trim(rest, "[]"), port)
+	}
+	return transport, rest, nil
+}
+
+// checkGroupLoop reports an error if g contains itself through nested
+// groups. path holds the names of the groups that led to g.
+func (cfg *AppConfig) checkGroupLoop(g GroupConfig, path []string) error {
+	if slices.Contains(path, g.Name) {
+		return fmt.Errorf("group loop: %s", strings.Join(append(path, g.Name), " -> "))
+	}
+	path = append(path, g.Name)
+	for _, m := range g.Members {
+		if sub, ok := cfg.FindGroup(m); ok {
+			if err := cfg.checkGroupLoop(sub, path); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
+
+// FindGroup returns the group named name.
+func (cfg *AppConfig) FindGroup(name string) (GroupConfig, bool) {
+	for _, g := range cfg.Groups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return GroupConfig{}, false
+}
+
+// DetourChain returns cfg.Servers[index] followed by the servers it is
+// reached through: its detour server, that server's detour, and so on.
+// Detours refer to servers by name.
+func (cfg *AppConfig) DetourChain(index int) ([]ServerConfig, error) {
+	chain := []ServerConfig{cfg.Servers[index]}
+	for {
+		last := chain[len(chain)-1]
+		if last.Detour == "" {
+			return chain, nil
+		}
+		next, ok := cfg.FindServer(last.Detour)
+		if !ok {
+			return nil, fmt.Errorf("detour server %q of %q not found", last.Detour, last.Name)
+		}
+		for _, s := range chain {
+			if s.Name == next.Name {
+				return nil, fmt.Errorf("detour loop: %s", chainNames(append(chain, next)))
+			}
+		}
+		chain = append(chain, next)
+	}
+}
+
+// FindServer returns the first server named name.
+func (cfg *AppConfig) FindServer(name string) (ServerConfig, bool) {
+	if i := cfg.ServerIndex(name); i >= 0 {
+		return cfg.Servers[i], true
+	}
+	return ServerConfig{}, false
+}
+
+// ServerIndex returns the index of the first server named name, or -1.
+func (cfg *AppConfig) ServerIndex(name string) int {
+	for i, s := range cfg.Servers {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func chainNames(chain []ServerConfig) string {
+	names := make([]string, len(chain))
+	for i, s := range chain {
+		names[i] = s.Name
+	}
+	return strings.Join(names, " -> ")
+}
+
+// ProxyInbounds returns the configured inbounds, or DefaultInbounds if none
+// are configured.
+func (cfg *AppConfig) ProxyInbounds() []InboundConfig {
+	if len(cfg.Inbounds) == 0 {
+		return DefaultInbounds
+	}
+	return cfg.Inbounds
+}
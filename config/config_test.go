@@ -0,0 +1,69 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// reload reads the config file at path with a viper instance of its own,
+// as a new process would.
+func reload(t *testing.T, path string) *AppConfig {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	var cfg AppConfig
+	if err := v.Unmarshal(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &cfg
+}
+
+func TestSaveConfigRoundTrip(t *testing.T) {
+	off := false
+	cfg := &AppConfig{
+		Mode:    "tun",
+		Servers: []ServerConfig{{Name: "a", Type: "socks5", Address: "192.0.2.1", Port: 1080}},
+		TUN: TUNConfig{
+			Name:          "utun7",
+			Address6:      TUNAddressNone,
+			MTU:           1400,
+			AutoRoute:     &off,
+			StrictRoute:   true,
+			IncludeRoutes: []string{"10.0.0.0/8"},
+			ExcludeRoutes: []string{"192.168.0.0/16", "172.16.0.0/12"},
+			DNS:           "1.1.1.1",
+		},
+		DNS: DNSConfig{
+			Servers: []DNSServerConfig{{Name: "cf", Address: "tls://1.1.1.1", Detour: "a"}},
+			FakeIP: FakeIPConfig{
+				Enabled: true,
+				Range:   "198.18.0.0/16",
+				Range6:  "fc00::/18",
+				Exclude: []string{"lan"},
+				Store:   "fakeip.json",
+			},
+			Hijack:    true,
+			HijackDoT: true,
+		},
+	}
+	path := filepath.Join(t.TempDir(), "nekogo.yaml")
+	if err := SaveConfig(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	got := reload(t, path)
+	if !reflect.DeepEqual(got.TUN, cfg.TUN) {
+		t.Errorf("TUN settings = %+v, want %+v", got.TUN, cfg.TUN)
+	}
+	if !reflect.DeepEqual(got.DNS, cfg.DNS) {
+		t.Errorf("DNS settings = %+v, want %+v", got.DNS, cfg.DNS)
+	}
+	if got.TUN.AutoRouteEnabled() {
+		t.Error("auto_route: false came back as on")
+	}
+}
@@ -0,0 +1,365 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout = 5 * time.Second
+
+	dnsCacheSize = 4096
+	// dnsNegativeTTL is how long, in seconds, answers without records are
+	// cached when the upstream gives no SOA record to go by.
+	dnsNegativeTTL    = 30
+	dnsMaxNegativeTTL = 300
+	dnsHostsTTL       = 60
+)
+
+// DNS resolves names through the configured upstream servers. Static hosts
+// are answered first, then the cache; other queries go to the server
+// chosen by the DNS rules, or to the first server.
+type DNS struct {
+	servers  map[string]*dnsUpstream
+	fallback *dnsUpstream
+	rules    []dnsRule
+	hosts    map[string][]netip.Addr
+	cache    *dnsCache
+
+	// fakeIP answers queries from the DNS listener and TUN clients with
+	// fake addresses, if set. Lookups by NekoGo itself get real ones.
+	fakeIP *FakeIPPool
+}
+
+type dnsRule struct {
+	server *dnsUpstream
+	match  func(m *metadata) bool
+}
+
+// newDNS creates the resolver of cfg.DNS. Upstreams reach their servers
+// through the outbounds that router returns for their detours.
+func newDNS(cfg *config.AppConfig, router *Router, dbs *ruleDatabases) (*DNS, error) {
+	d := &DNS{
+		servers: make(map[string]*dnsUpstream),
+		hosts:   make(map[string][]netip.Addr),
+		cache:   &dnsCache{entries: make(map[dnsCacheKey]dnsCacheEntry)},
+	}
+	for _, sc := range cfg.DNS.Servers {
+		detour := sc.Detour
+		if detour == "" {
+			detour = "direct"
+		}
+		u, err := newDNSUpstream(sc, func() (Dialer, error) { return router.outbound(detour) })
+		if err != nil {
+			return nil, fmt.Errorf("dns server %s: %w", sc.Name, err)
+		}
+		d.servers[sc.Name] = u
+		if d.fallback == nil {
+			d.fallback = u
+		}
+	}
+	for i, rc := range cfg.DNS.Rules {
+		match, err := compileRule(rc, dbs)
+		if err != nil {
+			return nil, fmt.Errorf("dns rule %d: %w", i+1, err)
+		}
+		d.rules = append(d.rules, dnsRule{server: d.servers[rc.Action], match: match})
+	}
+	for _, h := range cfg.DNS.Hosts {
+		name := strings.ToLower(strings.TrimSuffix(h.Domain, "."))
+		for _, a := range h.Addresses {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return nil, fmt.Errorf("dns hosts: %w", err)
+			}
+			d.hosts[name] = append(d.hosts[name], addr.Unmap())
+		}
+	}
+	return d, nil
+}
+
+// Exchange answers a query with a single question.
+func (d *DNS) Exchange(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	if len(query.Questions) != 1 {
+		return nil, errors.New("dns: query must have one question")
+	}
+	q := query.Questions[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if resp := d.fromHosts(query, name); resp != nil {
+		return resp, nil
+	}
+
+	key := dnsCacheKey{name: name, qtype: q.Type, class: q.Class}
+	if resp := d.cache.get(key); resp != nil {
+		resp.ID = query.ID
+		return resp, nil
+	}
+
+	u := d.upstreamFor(name)
+	ctx, cancel := context.WithTimeout(ctx, dnsTimeout)
+	defer cancel()
+	// Upstream queries get IDs of their own, so that spoofed responses need
+	// to guess them.
+	upQuery := *query
+	upQuery.ID = uint16(rand.Uint32())
+	upQuery.RecursionDesired = true
+	packed, err := upQuery.Pack()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := u.exchange(ctx, packed)
+	if err != nil {
+		return nil, fmt.Errorf("dns server %s: %w", u.name, err)
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("dns server %s: %w", u.name, err)
+	}
+	if resp.ID != upQuery.ID {
+		return nil, fmt.Errorf("dns server %s: response ID mismatch", u.name)
+	}
+	d.cache.put(key, &resp, raw)
+	resp.ID = query.ID
+	return &resp, nil
+}
+
+// answer answers a query from a client. Names that are not in the hosts or
+// excluded get fake addresses in fake-IP mode.
+func (d *DNS) answer(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	if d.fakeIP == nil || len(query.Questions) != 1 {
+		return d.Exchange(ctx, query)
+	}
+	q := query.Questions[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA || q.Class != dnsmessage.ClassINET {
+		return d.Exchange(ctx, query)
+	}
+	if _, ok := d.hosts[name]; ok || d.fakeIP.Excluded(name) {
+		return d.Exchange(ctx, query)
+	}
+	resp := dnsReply(query, dnsmessage.RCodeSuccess)
+	if addr, ok := d.fakeIP.Allocate(name, q.Type == dnsmessage.TypeAAAA); ok {
+		rr, _ := addressRecord(q.Name, addr, q.Type, fakeIPTTL)
+		resp.Answers = append(resp.Answers, rr)
+	}
+	return resp, nil
+}
+
+// SetFakeIP makes the DNS answer clients from pool, or stops doing so if
+// pool is nil.
+func (d *DNS) SetFakeIP(pool *FakeIPPool) {
+	d.fakeIP = pool
+}
+
+func (d *DNS) upstreamFor(name string) *dnsUpstream {
+	m := &metadata{domain: name}
+	for _, r := range d.rules {
+		if r.match(m) {
+			return r.server
+		}
+	}
+	return d.fallback
+}
+
+// fromHosts answers A and AAAA queries for names in the static hosts.
+func (d *DNS) fromHosts(query *dnsmessage.Message, name string) *dnsmessage.Message {
+	q := query.Questions[0]
+	addrs, ok := d.hosts[name]
+	if !ok || q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return nil
+	}
+	resp := dnsReply(query, dnsmessage.RCodeSuccess)
+	resp.Authoritative = true
+	for _, addr := range addrs {
+		if rr, ok := addressRecord(q.Name, addr, q.Type, dnsHostsTTL); ok {
+			resp.Answers = append(resp.Answers, rr)
+		}
+	}
+	return resp
+}
+
+// LookupIP resolves host to its IPv4 and IPv6 addresses.
+func (d *DNS) LookupIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([][]netip.Addr, len(types))
+	errs := make([]error, len(types))
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := &dnsmessage.Message{
+				Header:    dnsmessage.Header{RecursionDesired: true},
+				Questions: []dnsmessage.Question{{Name: name, Type: t, Class: dnsmessage.ClassINET}},
+			}
+			resp, err := d.Exchange(ctx, query)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = responseAddrs(resp)
+		}()
+	}
+	wg.Wait()
+
+	addrs := append(results[0], results[1]...)
+	if len(addrs) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs, nil
+}
+
+// responseAddrs returns the addresses in the A and AAAA answers of resp.
+func responseAddrs(resp *dnsmessage.Message) []netip.Addr {
+	var addrs []netip.Addr
+	for _, rr := range resp.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA).Unmap())
+		}
+	}
+	return addrs
+}
+
+// dnsReply starts a response to query with the given code.
+func dnsReply(query *dnsmessage.Message, rcode dnsmessage.RCode) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			OpCode:             query.OpCode,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: query.Questions,
+	}
+}
+
+// addressRecord returns an A or AAAA record, as qtype asks, for addr if it
+// is of that family.
+func addressRecord(name dnsmessage.Name, addr netip.Addr, qtype dnsmessage.Type, ttl uint32) (dnsmessage.Resource, bool) {
+	hdr := dnsmessage.ResourceHeader{Name: name, Type: qtype, Class: dnsmessage.ClassINET, TTL: ttl}
+	switch {
+	case qtype == dnsmessage.TypeA && addr.Is4():
+		return dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: addr.As4()}}, true
+	case qtype == dnsmessage.TypeAAAA && addr.Is6():
+		return dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}}, true
+	}
+	return dnsmessage.Resource{}, false
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	raw     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache holds upstream responses for as long as their records live.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]dnsCacheEntry
+}
+
+// get returns a cached response with its TTLs reduced by the time it has
+// been cached.
+func (c *dnsCache) get(key dnsCacheKey) *dnsmessage.Message {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(e.raw); err != nil {
+		return nil
+	}
+	age := uint32(time.Since(e.stored).Seconds())
+	for _, section := range [][]dnsmessage.Resource{resp.Answers, resp.Authorities, resp.Additionals} {
+		for i := range section {
+			if section[i].Header.Type != dnsmessage.TypeOPT {
+				section[i].Header.TTL -= min(age, section[i].Header.TTL)
+			}
+		}
+	}
+	return &resp
+}
+
+// put caches a successful or NXDOMAIN response for the lowest TTL of its
+// answers, or of its SOA record if it has no answers.
+func (c *dnsCache) put(key dnsCacheKey, resp *dnsmessage.Message, raw []byte) {
+	if resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError || resp.Truncated {
+		return
+	}
+	var ttl uint32
+	if len(resp.Answers) > 0 {
+		ttl = resp.Answers[0].Header.TTL
+		for _, rr := range resp.Answers[1:] {
+			ttl = min(ttl, rr.Header.TTL)
+		}
+	} else {
+		ttl = dnsNegativeTTL
+		for _, rr := range resp.Authorities {
+			if rr.Header.Type == dnsmessage.TypeSOA {
+				ttl = min(rr.Header.TTL, dnsMaxNegativeTTL)
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= dnsCacheSize {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full: make room by dropping an arbitrary entry.
+		for k := range c.entries {
+			if len(c.entries) < dnsCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = dnsCacheEntry{
+		raw:     raw,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
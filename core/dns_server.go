@@ -0,0 +1,198 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsIdleTimeout is how long a DNS over TCP client may stay silent between
+// queries.
+const dnsIdleTimeout = 30 * time.Second
+
+// DNSServer answers DNS queries from local clients over UDP and TCP with a
+// DNS resolver.
+type DNSServer struct {
+	dns *DNS
+	pc  net.PacketConn
+	ln  net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// ListenDNS serves d on addr over UDP and TCP. Call Close on the returned
+// server to stop it.
+func ListenDNS(d *DNS, addr string) (*DNSServer, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for DNS on %s: %w", addr, err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("failed to listen for DNS on %s: %w", addr, err)
+	}
+	s := &DNSServer{dns: d, pc: pc, ln: ln, conns: make(map[net.Conn]struct{})}
+	log.Printf("DNS server listening on %s", pc.LocalAddr())
+	go s.serveUDP()
+	go s.serveTCP()
+	return s, nil
+}
+
+func (s *DNSServer) serveUDP() {
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go func() {
+			resp := s.dns.handle(context.Background(), query, dnsUDPSize(query))
+			if resp != nil {
+				s.pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) serveTCP() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer s.untrack(conn)
+			serveDNSStream(s.dns, conn)
+		}()
+	}
+}
+
+func (s *DNSServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *DNSServer) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+// Close stops the server and closes its open TCP connections.
+func (s *DNSServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = make(map[net.Conn]struct{})
+	s.mu.Unlock()
+
+	s.ln.Close()
+	err := s.pc.Close()
+	for conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+// serveDNSStream answers length-prefixed queries on conn until the client
+// closes it or stays idle for too long.
+func serveDNSStream(d *DNS, conn net.Conn) {
+	var size [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp := d.handle(context.Background(), query, dnsMaxMessageSize)
+		if resp == nil {
+			return
+		}
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(resp)), uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers the packed query msg with a packed response of at most
+// maxSize bytes, truncating it if needed. It returns nil for messages
+// that cannot be answered at all.
+func (d *DNS) handle(ctx context.Context, msg []byte, maxSize int) []byte {
+	var query dnsmessage.Message
+	if err := query.Unpack(msg); err != nil || query.Response {
+		return nil
+	}
+	resp, err := d.answer(ctx, &query)
+	if err != nil {
+		if len(query.Questions) == 1 {
+			log.Printf("DNS query for %s failed: %v", query.Questions[0].Name, err)
+		}
+		resp = dnsReply(&query, dnsmessage.RCodeServerFailure)
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	if len(packed) > maxSize {
+		// Send the header and question only, telling the client to
+		// retry over TCP.
+		resp = dnsReply(&query, resp.RCode)
+		resp.Truncated = true
+		if packed, err = resp.Pack(); err != nil {
+			return nil
+		}
+	}
+	return packed
+}
+
+// dnsUDPSize returns the largest UDP response the client that sent the
+// packed query msg accepts: 512 bytes, or more if it says so in an EDNS(0)
+// OPT record.
+func dnsUDPSize(msg []byte) int {
+	size := 512
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return size
+	}
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return size
+	}
+	for {
+		hdr, err := p.AdditionalHeader()
+		if err != nil {
+			return size
+		}
+		if hdr.Type == dnsmessage.TypeOPT {
+			return max(size, int(hdr.Class))
+		}
+		if err := p.SkipAdditional(); err != nil {
+			return size
+		}
+	}
+}
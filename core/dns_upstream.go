@@ -0,0 +1,274 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsMaxMessageSize is the largest DNS message, the limit of the length
+// prefix used over TCP.
+const dnsMaxMessageSize = 65535
+
+// dnsUpstream sends queries to one DNS server over UDP, TCP, TLS or HTTPS,
+// through the outbound that dialer returns.
+type dnsUpstream struct {
+	name      string
+	transport string
+	addr      string // host:port, or the URL for "https"
+	dialer    func() (Dialer, error)
+	http      *http.Client
+
+	udpMu sync.Mutex
+	udp   *dnsUDPConn // nil until the first UDP query
+}
+
+// dnsUDPConn is the packet conn that an upstream sends its UDP queries on.
+// Concurrent queries share it, and responses are matched to them by ID, so
+// that queries through a proxy do not each need a handshake.
+type dnsUDPConn struct {
+	pc         net.PacketConn
+	lastActive atomic.Int64 // of the last response
+
+	mu      sync.Mutex
+	waiting map[uint16]chan []byte // by query ID
+	err     error                  // why the conn ended, once it has
+}
+
+func newDNSUpstream(sc config.DNSServerConfig, dialer func() (Dialer, error)) (*dnsUpstream, error) {
+	transport, addr, err := config.ParseDNSAddress(sc.Address)
+	if err != nil {
+		return nil, err
+	}
+	u := &dnsUpstream{name: sc.Name, transport: transport, addr: addr, dialer: dialer}
+	if transport == "https" {
+		u.http = &http.Client{
+			Transport: &http.Transport{
+				DialContext:         u.dial,
+				ForceAttemptHTTP2:   true,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: dnsTimeout,
+			},
+		}
+	}
+	return u, nil
+}
+
+func (u *dnsUpstream) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d, err := u.dialer()
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// exchange sends the packed query msg and returns the packed response.
+func (u *dnsUpstream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	ctx = withSystemResolver(ctx)
+	switch u.transport {
+	case "udp":
+		resp, err := u.exchangeUDP(ctx, msg)
+		if err == nil && isTruncated(resp) {
+			return u.exchangeStream(ctx, msg, false)
+		}
+		return resp, err
+	case "tcp":
+		return u.exchangeStream(ctx, msg, false)
+	case "tls":
+		return u.exchangeStream(ctx, msg, true)
+	case "https":
+		return u.exchangeHTTPS(ctx, msg)
+	}
+	return nil, fmt.Errorf("unsupported DNS transport: %s", u.transport)
+}
+
+// exchangeUDP sends msg on the shared packet conn of u. A query whose ID is
+// already in flight goes over TCP instead.
+func (u *dnsUpstream) exchangeUDP(ctx context.Context, msg []byte) ([]byte, error) {
+	c, err := u.udpConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(msg)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	if _, ok := c.waiting[id]; ok {
+		c.mu.Unlock()
+		return u.exchangeStream(ctx, msg, false)
+	}
+	ch := make(chan []byte, 1)
+	c.waiting[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.waiting[id] == ch {
+			delete(c.waiting, id)
+		}
+		c.mu.Unlock()
+	}()
+
+	if _, err := c.pc.WriteTo(msg, packetAddr(u.addr)); err != nil {
+		return nil, err
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, c.err
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// udpConn returns the shared packet conn of u, opening it if there is none.
+// The lock is held while it is opened, so that concurrent queries wait for
+// one conn rather than each opening their own.
+func (u *dnsUpstream) udpConn(ctx context.Context) (*dnsUDPConn, error) {
+	u.udpMu.Lock()
+	defer u.udpMu.Unlock()
+	if u.udp != nil {
+		return u.udp, nil
+	}
+	d, err := u.dialer()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := d.ListenPacket(ctx, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &dnsUDPConn{pc: pc, waiting: make(map[uint16]chan []byte)}
+	c.lastActive.Store(time.Now().UnixNano())
+	u.udp = c
+	go u.readUDP(c)
+	return c, nil
+}
+
+// readUDP hands the responses that arrive on c to the queries waiting for
+// them, until c fails or has had no response for udpSessionTimeout. Stray
+// datagrams, such as late responses to queries that gave up, are dropped.
+func (u *dnsUpstream) readUDP(c *dnsUDPConn) {
+	buf := make([]byte, dnsMaxMessageSize)
+	var err error
+	for {
+		c.pc.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		var n int
+		n, _, err = c.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, c.lastActive.Load())) < udpSessionTimeout {
+				continue
+			}
+			break
+		}
+		c.lastActive.Store(time.Now().UnixNano())
+		if n < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(buf)
+		c.mu.Lock()
+		if ch, ok := c.waiting[id]; ok {
+			ch <- bytes.Clone(buf[:n])
+			delete(c.waiting, id)
+		}
+		c.mu.Unlock()
+	}
+
+	u.udpMu.Lock()
+	if u.udp == c {
+		u.udp = nil
+	}
+	u.udpMu.Unlock()
+	c.pc.Close()
+	c.mu.Lock()
+	c.err = err
+	for _, ch := range c.waiting {
+		close(ch)
+	}
+	c.waiting = nil
+	c.mu.Unlock()
+}
+
+// exchangeStream sends msg over a new TCP connection, wrapped in TLS if
+// useTLS is set, with the two-byte length prefix of RFC 1035 section 4.2.2.
+func (u *dnsUpstream) exchangeStream(ctx context.Context, msg []byte, useTLS bool) ([]byte, error) {
+	conn, err := u.dial(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if useTLS {
+		host, _, _ := net.SplitHostPort(u.addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	if _, err := conn.Write(append(req, msg...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeHTTPS sends msg as a DNS over HTTPS POST request (RFC 8484).
+func (u *dnsUpstream) exchangeHTTPS(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.addr, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > dnsMaxMessageSize {
+		return nil, errors.New("response too large")
+	}
+	return body, nil
+}
+
+// isTruncated reports whether the TC bit of a packed DNS message is set.
+func isTruncated(msg []byte) bool {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(msg)
+	return err == nil && hdr.Truncated
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+// countingDialer is Direct, counting the UDP sessions it opens.
+type countingDialer struct {
+	Dialer
+	listens atomic.Int32
+}
+
+func (d *countingDialer) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	d.listens.Add(1)
+	return d.Dialer.ListenPacket(ctx, addr)
+}
+
+// TestDNSUpstreamSharesUDPConn checks that concurrent UDP queries share one
+// packet conn and get their own responses, which the server sends in
+// reverse order.
+func TestDNSUpstreamSharesUDPConn(t *testing.T) {
+	const queries = 4
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		type query struct {
+			msg  []byte
+			from net.Addr
+		}
+		var got []query
+		buf := make([]byte, dnsMaxMessageSize)
+		for len(got) < queries {
+			n, from, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			got = append(got, query{bytes.Clone(buf[:n]), from})
+		}
+		for i := len(got) - 1; i >= 0; i-- {
+			server.WriteTo(append(got[i].msg, "reply"...), got[i].from)
+		}
+	}()
+
+	dialer := &countingDialer{Dialer: Direct}
+	u, err := newDNSUpstream(config.DNSServerConfig{Name: "test", Address: server.LocalAddr().String()},
+		func() (Dialer, error) { return dialer, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A DNS header with only the ID set, and a byte to tell the
+			// queries apart.
+			msg := make([]byte, 13)
+			msg[1], msg[12] = byte(i+1), byte(i)
+			resp, err := u.exchange(ctx, msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if want := append(msg, "reply"...); !bytes.Equal(resp, want) {
+				t.Errorf("query %d got %x, want %x", i, resp, want)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := dialer.listens.Load(); n != 1 {
+		t.Errorf("opened %d UDP sessions, want 1", n)
+	}
+}
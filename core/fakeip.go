@@ -0,0 +1,258 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+const (
+	// fakeIPTTL is the TTL, in seconds, of fake-IP answers. It is short so
+	// that clients come back for a fresh answer once a mapping may have
+	// been reused.
+	fakeIPTTL = 1
+
+	// fakeIPMaxEntries bounds the addresses handed out from one range, so
+	// that large IPv6 ranges do not grow the table without limit. Once a
+	// range is used up, the oldest mappings are reused.
+	fakeIPMaxEntries = 65536
+)
+
+// FakeIPPool maps domain names to addresses from reserved ranges and back.
+type FakeIPPool struct {
+	mu      sync.Mutex
+	v4, v6  *fakeIPRange // v6 is nil if there is no IPv6 range
+	exclude []string
+	store   string
+}
+
+// fakeIPRange hands out the addresses of a prefix in order, starting over
+// at the beginning once it reaches its size.
+type fakeIPRange struct {
+	prefix netip.Prefix
+	size   uint64 // addresses handed out, from offset 1
+	next   uint64 // offset of the next address to hand out
+	byAddr map[netip.Addr]string
+	byName map[string]netip.Addr
+}
+
+// NewFakeIPPool creates the pool of cfg, restoring its mapping from the
+// store file if there is one.
+func NewFakeIPPool(cfg config.FakeIPConfig) (*FakeIPPool, error) {
+	p := &FakeIPPool{store: cfg.Store}
+	var err error
+	if p.v4, err = newFakeIPRange(cfg.IPv4Range()); err != nil {
+		return nil, err
+	}
+	if cfg.Range6 != "" {
+		if p.v6, err = newFakeIPRange(cfg.Range6); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range cfg.Exclude {
+		p.exclude = append(p.exclude, strings.ToLower(strings.Trim(s, ".")))
+	}
+	if p.store != "" {
+		if err := p.load(); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to load fake-IP store: %w", err)
+		}
+	}
+	return p, nil
+}
+
+func newFakeIPRange(cidr string) (*fakeIPRange, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+	// Leave out the first address and, for IPv4, the broadcast address.
+	size := uint64(fakeIPMaxEntries)
+	if hostBits := prefix.Addr().BitLen() - prefix.Bits(); hostBits < 32 {
+		size = min(size, uint64(1)<<hostBits-2)
+	}
+	return &fakeIPRange{
+		prefix: prefix,
+		size:   size,
+		next:   1,
+		byAddr: make(map[netip.Addr]string),
+		byName: make(map[string]netip.Addr),
+	}, nil
+}
+
+// addr returns the address at offset from the start of the range.
+func (r *fakeIPRange) addr(offset uint64) netip.Addr {
+	if r.prefix.Addr().Is4() {
+		b := r.prefix.Addr().As4()
+		binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(b[:])+uint32(offset))
+		return netip.AddrFrom4(b)
+	}
+	b := r.prefix.Addr().As16()
+	binary.BigEndian.PutUint64(b[8:], binary.BigEndian.Uint64(b[8:])+offset)
+	return netip.AddrFrom16(b)
+}
+
+// allocate returns the address of name, mapping it to the next address if
+// it has none. The previous name of that address loses its mapping.
+func (r *fakeIPRange) allocate(name string) netip.Addr {
+	if addr, ok := r.byName[name]; ok {
+		return addr
+	}
+	addr := r.addr(r.next)
+	r.next = r.next%r.size + 1
+	r.set(addr, name)
+	return addr
+}
+
+func (r *fakeIPRange) set(addr netip.Addr, name string) {
+	if old, ok := r.byAddr[addr]; ok {
+		delete(r.byName, old)
+	}
+	if old, ok := r.byName[name]; ok {
+		delete(r.byAddr, old)
+	}
+	r.byAddr[addr] = name
+	r.byName[name] = addr
+}
+
+// Excluded reports whether name is to be answered with its real addresses.
+func (p *FakeIPPool) Excluded(name string) bool {
+	for _, s := range p.exclude {
+		if name == s || strings.HasSuffix(name, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allocate returns the fake IPv4 or IPv6 address of name. It returns false
+// if IPv6 is asked for and there is no IPv6 range.
+func (p *FakeIPPool) Allocate(name string, ipv6 bool) (netip.Addr, bool) {
+	r := p.v4
+	if ipv6 {
+		r = p.v6
+	}
+	if r == nil {
+		return netip.Addr{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return r.allocate(name), true
+}
+
+// Contains reports whether addr is in one of the pool's ranges.
+func (p *FakeIPPool) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return p.v4.prefix.Contains(addr) || p.v6 != nil && p.v6.prefix.Contains(addr)
+}
+
+// Lookup returns the domain name that addr stands for.
+func (p *FakeIPPool) Lookup(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, r := range []*fakeIPRange{p.v4, p.v6} {
+		if r != nil && r.prefix.Contains(addr) {
+			name, ok := r.byAddr[addr]
+			return name, ok
+		}
+	}
+	return "", false
+}
+
+// Close saves the mapping to the store file, if there is one.
+func (p *FakeIPPool) Close() error {
+	if p.store == "" {
+		return nil
+	}
+	if err := p.save(); err != nil {
+		return fmt.Errorf("failed to save fake-IP store: %w", err)
+	}
+	return nil
+}
+
+// load reads a store file of "address name" lines, oldest mapping first.
+// Addresses outside the current ranges are skipped, so that a changed range
+// starts out empty.
+func (p *FakeIPPool) load() error {
+	f, err := os.Open(p.store)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		addrStr, name, ok := strings.Cut(sc.Text(), " ")
+		addr, err := netip.ParseAddr(addrStr)
+		if !ok || err != nil || name == "" {
+			continue
+		}
+		for _, r := range []*fakeIPRange{p.v4, p.v6} {
+			if r == nil || !r.prefix.Contains(addr) {
+				continue
+			}
+			if offset := r.offset(addr); offset >= 1 && offset <= r.size {
+				r.set(addr, name)
+				r.next = offset%r.size + 1
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// offset returns the position of addr in the range.
+func (r *fakeIPRange) offset(addr netip.Addr) uint64 {
+	if addr.Is4() {
+		a, b := addr.As4(), r.prefix.Addr().As4()
+		return uint64(binary.BigEndian.Uint32(a[:]) - binary.BigEndian.Uint32(b[:]))
+	}
+	a, b := addr.As16(), r.prefix.Addr().As16()
+	if string(a[:8]) != string(b[:8]) {
+		return 0 // beyond the addresses handed out
+	}
+	return binary.BigEndian.Uint64(a[8:]) - binary.BigEndian.Uint64(b[8:])
+}
+
+// save writes the mapping in the order it was handed out, so that load
+// resumes allocating where the pool left off.
+func (p *FakeIPPool) save() error {
+	p.mu.Lock()
+	var b strings.Builder
+	for _, r := range []*fakeIPRange{p.v4, p.v6} {
+		if r == nil {
+			continue
+		}
+		for i := range r.size {
+			addr := r.addr((r.next-1+i)%r.size + 1)
+			if name, ok := r.byAddr[addr]; ok {
+				fmt.Fprintf(&b, "%s %s\n", addr, name)
+			}
+		}
+	}
+	p.mu.Unlock()
+	return os.WriteFile(p.store, []byte(b.String()), 0o644)
+}
+
+// target returns the address to dial for a connection to dst: the domain
+// name dst stands for if it is a fake IP, or dst itself. It fails for fake
+// IPs without a mapping, such as ones handed out before a restart.
+func (p *FakeIPPool) target(dst netip.AddrPort) (string, error) {
+	if p == nil || !p.Contains(dst.Addr()) {
+		return dst.String(), nil
+	}
+	name, ok := p.Lookup(dst.Addr())
+	if !ok {
+		return "", fmt.Errorf("no domain for fake IP %s", dst.Addr())
+	}
+	return net.JoinHostPort(name, strconv.Itoa(int(dst.Port()))), nil
+}
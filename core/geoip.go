@@ -0,0 +1,285 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errMMDBTruncated = errors.New("data section truncated")
+
+// GeoIP looks up the country of IP addresses in a MaxMind DB (mmdb) file,
+// such as GeoLite2-Country or the country databases published for v2ray
+// and sing-box. The whole file is held in memory.
+type GeoIP struct {
+	buf        []byte
+	data       []byte // the data section
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint // node of ::/96, where IPv4 lookups start
+	ipv6       bool
+
+	mu        sync.Mutex
+	countries map[uint]string // data offset -> country code
+}
+
+// LoadGeoIP reads the MaxMind DB at path.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := parseGeoIP(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+func parseGeoIP(buf []byte) (*GeoIP, error) {
+	start := max(0, len(buf)-128*1024)
+	i := bytes.LastIndex(buf[start:], mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta, _, err := mmdbDecode(buf[start+i+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+	switch recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(len(buf)) {
+		return nil, errors.New("search tree exceeds file")
+	}
+
+	db := &GeoIP{
+		buf:        buf,
+		data:       buf[treeSize+16:],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		countries:  make(map[uint]string),
+		ipv6:       ipVersion == 6,
+	}
+	if db.ipv6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *GeoIP) record(node uint, bit byte) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		if bit == 1 {
+			b = b[3:]
+		}
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[uint(bit)*4:]))
+	}
+}
+
+// Country returns the ISO 3166-1 country code of ip in lower case, or "" if
+// the database has none.
+func (db *GeoIP) Country(ip netip.Addr) string {
+	ip = ip.Unmap()
+	if !ip.Is4() && !db.ipv6 {
+		return ""
+	}
+	node := uint(0)
+	bits := ip.AsSlice()
+	if ip.Is4() {
+		node = db.ipv4Start
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, bits[i/8]>>(7-i%8)&1)
+	}
+	if node <= db.nodeCount {
+		return ""
+	}
+	offset := node - db.nodeCount - 16
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if code, ok := db.countries[offset]; ok {
+		return code
+	}
+	code := ""
+	if v, _, err := mmdbDecode(db.data, offset, 0); err == nil {
+		code = mmdbCountry(v)
+	}
+	db.countries[offset] = code
+	return code
+}
+
+// mmdbCountry picks the country code out of a record of a GeoIP2 or
+// GeoLite2 country database. Records that are just a string, as in some
+// slimmed-down databases, are taken as the code itself.
+func mmdbCountry(v any) string {
+	if s, ok := v.(string); ok {
+		return strings.ToLower(s)
+	}
+	rec, _ := v.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return strings.ToLower(code)
+			}
+		}
+	}
+	return ""
+}
+
+// mmdbDecode decodes the value at offset in a MaxMind DB data section and
+// returns it with the offset that follows it. Maps become map[string]any,
+// arrays []any and all unsigned integers uint64.
+func mmdbDecode(data []byte, offset uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	if offset >= uint(len(data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	ctrl := data[offset]
+	offset++
+	typ := ctrl >> 5
+	if typ == 1 { // pointer
+		ss := ctrl >> 3 & 3
+		n := uint(ss) + 1
+		if offset+n > uint(len(data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		b := data[offset : offset+n]
+		var p uint
+		switch ss {
+		case 0:
+			p = uint(ctrl&7)<<8 | uint(b[0])
+		case 1:
+			p = (uint(ctrl&7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			p = (uint(ctrl&7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := mmdbDecode(data, p, depth+1)
+		return v, offset + n, err
+	}
+	if typ == 0 { // extended
+		if offset >= uint(len(data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		typ = 7 + data[offset]
+		offset++
+	}
+	size := uint(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errMMDBTruncated
+		}
+		var extra uint
+		for _, b := range data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := mmdbDecode(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next, err := mmdbDecode(data, next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for range size {
+			v, next, err := mmdbDecode(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean, held in the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errMMDBTruncated
+	}
+	b := data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return b, offset, nil
+	case 5, 6, 9, 10: // unsigned integers, uint128 truncated
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, offset, nil
+	case 8: // int32
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int32(u), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Domain types of a geosite.dat Domain message.
+const (
+	geositeKeyword = 0 // Plain
+	geositeRegex   = 1
+	geositeSuffix  = 2 // RootDomain
+	geositeFull    = 3
+)
+
+var errGeoSiteInvalid = errors.New("invalid geosite.dat")
+
+// DomainSet matches domain names against full names, suffixes, keywords
+// and regular expressions. Full names and suffixes are looked up in maps,
+// so large sets stay cheap to match.
+type DomainSet struct {
+	full     map[string]bool
+	suffixes map[string]bool
+	keywords []string
+	regexes  []*regexp.Regexp
+}
+
+func newDomainSet() *DomainSet {
+	return &DomainSet{full: make(map[string]bool), suffixes: make(map[string]bool)}
+}
+
+// Match reports whether domain, in lower case, is in the set.
+func (s *DomainSet) Match(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	if s.full[domain] {
+		return true
+	}
+	for d := domain; ; {
+		if s.suffixes[d] {
+			return true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	for _, k := range s.keywords {
+		if strings.Contains(domain, k) {
+			return true
+		}
+	}
+	for _, re := range s.regexes {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadGeoSite reads the categories named in lists from the v2ray-format
+// geosite.dat at path. A list is a category such as "google", or a
+// category and attribute such as "google@cn" for only the domains with that
+// attribute. The returned sets are keyed by list, in lower case.
+func LoadGeoSite(path string, lists []string) (map[string]*DomainSet, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// wanted maps each category to the attributes asked for, "" for all.
+	wanted := make(map[string][]string)
+	for _, l := range lists {
+		l = strings.ToLower(l)
+		category, attr, _ := strings.Cut(l, "@")
+		wanted[category] = append(wanted[category], attr)
+	}
+
+	sets := make(map[string]*DomainSet)
+	// GeoSiteList: repeated GeoSite entry = 1
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return nil, fmt.Errorf("%s: %w", path, errGeoSiteInvalid)
+		}
+		buf = buf[n:]
+		if num != 1 || typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, buf); n < 0 {
+				return nil, fmt.Errorf("%s: %w", path, errGeoSiteInvalid)
+			}
+			buf = buf[n:]
+			continue
+		}
+		entry, n := protowire.ConsumeBytes(buf)
+		if n < 0 {
+			return nil, fmt.Errorf("%s: %w", path, errGeoSiteInvalid)
+		}
+		buf = buf[n:]
+		if err := parseGeoSite(entry, wanted, sets); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	for _, l := range lists {
+		if sets[strings.ToLower(l)] == nil {
+			return nil, fmt.Errorf("%s has no category %s", path, l)
+		}
+	}
+	return sets, nil
+}
+
+// parseGeoSite adds the domains of a GeoSite message to sets if its
+// category is wanted. GeoSite is
+//
+//	string country_code = 1; repeated Domain domain = 2;
+func parseGeoSite(b []byte, wanted map[string][]string, sets map[string]*DomainSet) error {
+	var category string
+	var domains [][]byte
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return errGeoSiteInvalid
+		}
+		b = b[n:]
+		if typ != protowire.BytesType || num != 1 && num != 2 {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return errGeoSiteInvalid
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return errGeoSiteInvalid
+		}
+		b = b[n:]
+		if num == 1 {
+			category = strings.ToLower(string(v))
+			if _, ok := wanted[category]; !ok {
+				return nil // skip the domains of unwanted categories
+			}
+		} else {
+			domains = append(domains, v)
+		}
+	}
+	attrs, ok := wanted[category]
+	if !ok {
+		return nil
+	}
+	for _, attr := range attrs {
+		list := category
+		if attr != "" {
+			list += "@" + attr
+		}
+		if sets[list] == nil {
+			sets[list] = newDomainSet()
+		}
+	}
+
+	for _, d := range domains {
+		dtype, value, dattrs, err := parseGeoSiteDomain(d)
+		if err != nil {
+			return err
+		}
+		for _, attr := range attrs {
+			if attr != "" && !slices.Contains(dattrs, attr) {
+				continue
+			}
+			list := category
+			if attr != "" {
+				list += "@" + attr
+			}
+			if err := sets[list].add(dtype, value); err != nil {
+				return fmt.Errorf("category %s: %w", category, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseGeoSiteDomain parses a Domain message:
+//
+//	Type type = 1; string value = 2; repeated Attribute attribute = 3;
+//
+// where Attribute has its key in field 1.
+func parseGeoSiteDomain(b []byte) (dtype uint64, value string, attrs []string, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, "", nil, errGeoSiteInvalid
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			dtype, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			value = string(v)
+		case num == 3 && typ == protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				attrs = append(attrs, attributeKey(v))
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return 0, "", nil, errGeoSiteInvalid
+		}
+		b = b[n:]
+	}
+	return dtype, value, attrs, nil
+}
+
+func attributeKey(b []byte) string {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ""
+		}
+		b = b[n:]
+		if num == 1 && typ == protowire.BytesType {
+			v, _ := protowire.ConsumeBytes(b)
+			return strings.ToLower(string(v))
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return ""
+		}
+		b = b[n:]
+	}
+	return ""
+}
+
+func (s *DomainSet) add(dtype uint64, value string) error {
+	switch dtype {
+	case geositeKeyword:
+		s.keywords = append(s.keywords, strings.ToLower(value))
+	case geositeRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		s.regexes = append(s.regexes, re)
+	case geositeSuffix:
+		s.suffixes[strings.ToLower(value)] = true
+	case geositeFull:
+		s.full[strings.ToLower(value)] = true
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	defaultGroupInterval = 300 * time.Second
+	// groupRecheckDelay is the least time between health checks triggered
+	// by failed connections.
+	groupRecheckDelay = 10 * time.Second
+	groupCheckTimeout = 5 * time.Second
+)
+
+// Group is the outbound of a server group. For each connection it picks
+// one member according to its type:
+//
+//   - selector uses the member chosen by the user.
+//   - url-test uses the member with the lowest latency, switching only when
+//     another member is faster by more than the tolerance.
+//   - fallback uses the first healthy member.
+//   - load-balance spreads connections over the healthy members, either by
+//     destination (consistent hashing) or in turn (round-robin).
+//
+// Except for selectors, groups check the health of their members by
+// fetching a URL through each of them periodically, and sooner when a
+// connection through a member fails.
+type Group struct {
+	Name string
+	Type string
+
+	members    []groupMember
+	url        string
+	interval   time.Duration
+	tolerance  time.Duration
+	roundRobin bool
+
+	mu       sync.RWMutex
+	selected int             // selector and url-test
+	delays   []time.Duration // of the last check: 0 if unknown, -1 if failed
+
+	next    atomic.Uint32
+	recheck chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type groupMember struct {
+	name   string
+	dialer Dialer
+}
+
+func newGroup(cfg config.GroupConfig, members []groupMember) *Group {
+	g := &Group{
+		Name:       cfg.Name,
+		Type:       cfg.Type,
+		members:    members,
+		url:        cfg.URL,
+		interval:   time.Duration(cfg.Interval) * time.Second,
+		tolerance:  time.Duration(cfg.Tolerance) * time.Millisecond,
+		roundRobin: cfg.Strategy == "round-robin",
+		delays:     make([]time.Duration, len(members)),
+		recheck:    make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	if g.url == "" {
+		g.url = LatencyTestURL
+	}
+	if g.interval == 0 {
+		g.interval = defaultGroupInterval
+	}
+	for i, m := range members {
+		if m.name == cfg.Selected {
+			g.selected = i
+		}
+	}
+	if g.Type != "selector" {
+		go g.run()
+	}
+	return g
+}
+
+func (g *Group) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	i := g.pick(addr)
+	conn, err := g.members[i].dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		g.checkSoon()
+		return nil, fmt.Errorf("%s: %w", g.members[i].name, err)
+	}
+	return conn, nil
+}
+
+func (g *Group) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	i := g.pick(addr)
+	pc, err := g.members[i].dialer.ListenPacket(ctx, addr)
+	if err != nil {
+		g.checkSoon()
+		return nil, fmt.Errorf("%s: %w", g.members[i].name, err)
+	}
+	return pc, nil
+}
+
+// pick returns the index of the member to use for a connection to addr.
+func (g *Group) pick(addr string) int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	switch g.Type {
+	case "fallback":
+		for i, d := range g.delays {
+			if d >= 0 {
+				return i
+			}
+		}
+		return 0
+	case "load-balance":
+		var healthy []int
+		for i, d := range g.delays {
+			if d >= 0 {
+				healthy = append(healthy, i)
+			}
+		}
+		if len(healthy) == 0 {
+			return int(g.next.Add(1)-1) % len(g.members)
+		}
+		if g.roundRobin {
+			return healthy[int(g.next.Add(1)-1)%len(healthy)]
+		}
+		return g.hashPick(hashKey(addr), healthy)
+	default:
+		return g.selected
+	}
+}
+
+// hashPick picks the member for key by rendezvous hashing, so that a
+// destination keeps its member as long as that member stays healthy.
+func (g *Group) hashPick(key string, candidates []int) int {
+	best, bestScore := candidates[0], uint64(0)
+	for _, i := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(g.members[i].name))
+		if score := h.Sum64(); score >= bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// hashKey returns the part of a destination that load balancing hashes:
+// the registrable domain of a host name, so that sites spread over several
+// subdomains use one member, or the IP address.
+func hashKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// Members returns the names of the group's members.
+func (g *Group) Members() []string {
+	names := make([]string, len(g.members))
+	for i, m := range g.members {
+		names[i] = m.name
+	}
+	return names
+}
+
+// Now returns the name of the member in use, or "" for load-balance
+// groups, which use several.
+func (g *Group) Now() string {
+	if g.Type == "load-balance" {
+		return ""
+	}
+	return g.members[g.pick("")].name
+}
+
+// Select makes a selector use the member named name.
+func (g *Group) Select(name string) error {
+	if g.Type != "selector" {
+		return fmt.Errorf("group %s is not a selector", g.Name)
+	}
+	for i, m := range g.members {
+		if m.name == name {
+			g.mu.Lock()
+			g.selected = i
+			g.mu.Unlock()
+			log.Printf("Group %s: selected %s", g.Name, name)
+			return nil
+		}
+	}
+	return fmt.Errorf("group %s has no member named %q", g.Name, name)
+}
+
+// Close stops the health checks.
+func (g *Group) Close() error {
+	g.once.Do(func() { close(g.stop) })
+	return nil
+}
+
+func (g *Group) checkSoon() {
+	if g.Type == "selector" {
+		return
+	}
+	select {
+	case g.recheck <- struct{}{}:
+	default:
+	}
+}
+
+func (g *Group) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var last time.Time
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-timer.C:
+		case <-g.recheck:
+			if time.Since(last) < groupRecheckDelay {
+				continue
+			}
+		}
+		last = time.Now()
+		g.check()
+		timer.Reset(g.interval)
+	}
+}
+
+// check tests every member concurrently and updates the group's choice.
+func (g *Group) check() {
+	delays := make([]time.Duration, len(g.members))
+	var wg sync.WaitGroup
+	for i, m := range g.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), groupCheckTimeout)
+			defer cancel()
+			d, err := URLTest(ctx, m.dialer, g.url)
+			if err != nil {
+				delays[i] = -1
+				return
+			}
+			delays[i] = max(d, 1) // 0 means unknown
+		}()
+	}
+	wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.delays = delays
+	if g.Type != "url-test" {
+		return
+	}
+	best := -1
+	for i, d := range delays {
+		if d > 0 && (best < 0 || d < delays[best]) {
+			best = i
+		}
+	}
+	cur := delays[g.selected]
+	if best >= 0 && best != g.selected && (cur < 0 || delays[best]+g.tolerance < cur) {
+		log.Printf("Group %s: switched from %s to %s (%d ms)", g.Name, g.members[g.selected].name, g.members[best].name, delays[best].Milliseconds())
+		g.selected = best
+	}
+}
+
+// runningOutbounds holds the outbounds of the proxy or TUN session that is
+// running, if any, so that groups can be switched without restarting it.
+var runningOutbounds atomic.Pointer[Outbounds]
+
+func setRunning(old, next *Outbounds) {
+	runningOutbounds.CompareAndSwap(old, next)
+}
+
+// SelectGroupMember makes the selector group in the running session use
+// member. Callers save the choice in the config themselves, which also
+// covers groups the session has not used yet.
+func SelectGroupMember(group, member string) error {
+	o := runningOutbounds.Load()
+	if o == nil {
+		return nil
+	}
+	g, ok := o.Group(group)
+	if !ok {
+		return nil
+	}
+	return g.Select(member)
+}
+
+// RunningGroup returns the group named name of the running session, if
+// the session has created it.
+func RunningGroup(name string) (*Group, bool) {
+	o := runningOutbounds.Load()
+	if o == nil {
+		return nil, false
+	}
+	return o.Group(name)
+}
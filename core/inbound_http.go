@@ -0,0 +1,246 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers of RFC 7230 section 6.1. They only
+// apply to a single connection and are never forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ServeHTTP handles HTTP proxy requests: CONNECT is tunneled through the
+// outbound, everything else is forwarded to the absolute request URL.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(withSource(r.Context(), r.RemoteAddr))
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		http.Error(w, "Request must use an absolute URI", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		http.Error(w, "Unsupported URL scheme", http.StatusBadRequest)
+		return
+	}
+
+	upgrade := upgradeType(r.Header)
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.Close = false
+	if r.ContentLength == 0 {
+		req.Body = nil
+	}
+	removeHopHeaders(req.Header)
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Keep the transport from adding its own User-Agent.
+		req.Header.Set("User-Agent", "")
+	}
+
+	if upgrade != "" {
+		p.serveUpgrade(w, req, upgrade)
+		return
+	}
+	p.forward(w, req)
+}
+
+// serveConnect tunnels a CONNECT request to its target.
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	log.Printf("HTTPS CONNECT %s", r.Host)
+	conn, err := p.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, "Failed to connect to target", http.StatusServiceUnavailable)
+		return
+	}
+	defer conn.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "Hijack failed", http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	relay(newBufferedConn(clientConn, bufrw.Reader), conn)
+}
+
+// forward sends req to its target over a pooled connection through the
+// outbound and streams the response back.
+func (p *Proxy) forward(w http.ResponseWriter, req *http.Request) {
+	log.Printf("HTTP %s %s", req.Method, req.URL)
+	if req.Body != nil {
+		req.Body = countedBody{req.Body}
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		log.Printf("HTTP proxy error: %v", err)
+		http.Error(w, "Failed to reach target", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	writeResponse(w, resp)
+}
+
+// serveUpgrade forwards a request asking to switch protocols, such as a
+// WebSocket handshake. If the target agrees, the client connection is
+// relayed to it as is.
+func (p *Proxy) serveUpgrade(w http.ResponseWriter, req *http.Request, upgrade string) {
+	log.Printf("HTTP %s upgrade %s", upgrade, req.URL)
+	if req.URL.Scheme != "http" {
+		http.Error(w, "Upgrade requires an http URL", http.StatusBadRequest)
+		return
+	}
+	conn, err := p.dialer.DialContext(req.Context(), "tcp", urlHostPort(req.URL))
+	if err != nil {
+		http.Error(w, "Failed to connect to target", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgrade)
+	if err := req.Write(conn); err != nil {
+		http.Error(w, "Failed to send request", http.StatusBadGateway)
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		http.Error(w, "Failed to read response", http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		writeResponse(w, resp)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	clientConn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, "Hijack failed", http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+	// The 101 response keeps its Connection and Upgrade headers, since they
+	// complete the handshake on the client's side.
+	fmt.Fprintf(bufrw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(bufrw)
+	bufrw.WriteString("\r\n")
+	if err := bufrw.Flush(); err != nil {
+		return
+	}
+	relay(newBufferedConn(clientConn, bufrw.Reader), newBufferedConn(conn, br))
+}
+
+// writeResponse copies resp to w without its hop-by-hop headers, flushing
+// as the body arrives so that streamed responses are not held back.
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	removeHopHeaders(resp.Header)
+	header := w.Header()
+	for k, vv := range resp.Header {
+		header[k] = vv
+	}
+	for k := range resp.Trailer {
+		header.Add("Trailer", k)
+	}
+	w.WriteHeader(resp.StatusCode)
+	copyCounted(flushWriter{w}, resp.Body, AddBytesReceived)
+	for k, vv := range resp.Trailer {
+		header[k] = vv
+	}
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including those
+// named in its Connection header, and any Proxy-* header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	for name := range h {
+		if strings.HasPrefix(name, "Proxy-") {
+			delete(h, name)
+		}
+	}
+}
+
+// upgradeType returns the protocol a request asks to upgrade to, or "" if
+// it does not ask for one.
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// urlHostPort returns the "host:port" of u, using the scheme's default port
+// if none is given.
+func urlHostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// countedBody accounts a request body read by the transport as sent traffic.
+type countedBody struct {
+	io.ReadCloser
+}
+
+func (b countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	AddBytesSent(int64(n))
+	return n, err
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	http.NewResponseController(f.w).Flush()
+	return n, err
+}
@@ -0,0 +1,343 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	socks4Version    = 0x04
+	socks4Granted    = 0x5A
+	socks4Rejected   = 0x5B
+	socks4CmdConnect = 0x01
+
+	socks5NoAuth       = 0x00
+	socks5NoAcceptable = 0xFF
+
+	socks5Succeeded       = 0x00
+	socks5GeneralFailure  = 0x01
+	socks5HostUnreachable = 0x04
+	socks5CmdNotSupported = 0x07
+)
+
+// serveSocks handles a SOCKS4, SOCKS4a or SOCKS5 client whose first bytes
+// are buffered in br.
+func (p *Proxy) serveSocks(conn net.Conn, br *bufio.Reader) {
+	defer conn.Close()
+	ver, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	switch ver[0] {
+	case socks4Version:
+		err = p.serveSocks4(conn, br)
+	case socks5Version:
+		err = p.serveSocks5(conn, br)
+	default:
+		err = fmt.Errorf("unsupported SOCKS version %d", ver[0])
+	}
+	if err != nil {
+		log.Printf("SOCKS error from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// serveSocks4 handles a SOCKS4 or SOCKS4a CONNECT request.
+func (p *Proxy) serveSocks4(conn net.Conn, br *bufio.Reader) error {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return err
+	}
+	// The user ID is not used, since no authentication is required.
+	if _, err := br.ReadString(0); err != nil {
+		return err
+	}
+	port := strconv.Itoa(int(hdr[2])<<8 | int(hdr[3]))
+	host := net.IP(hdr[4:8]).String()
+	if hdr[4] == 0 && hdr[5] == 0 && hdr[6] == 0 && hdr[7] != 0 {
+		// SOCKS4a: the domain name follows the user ID.
+		domain, err := br.ReadString(0)
+		if err != nil {
+			return err
+		}
+		host = domain[:len(domain)-1]
+	}
+	reply := []byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0}
+	if hdr[1] != socks4CmdConnect {
+		conn.Write(reply)
+		return fmt.Errorf("unsupported SOCKS4 command %d", hdr[1])
+	}
+
+	target := net.JoinHostPort(host, port)
+	upstream, err := p.dialer.DialContext(withSource(context.Background(), conn.RemoteAddr().String()), "tcp", target)
+	if err != nil {
+		conn.Write(reply)
+		return fmt.Errorf("failed to connect to %s: %w", target, err)
+	}
+	defer upstream.Close()
+	reply[1] = socks4Granted
+	if _, err := conn.Write(reply); err != nil {
+		return err
+	}
+	relay(newBufferedConn(conn, br), upstream)
+	return nil
+}
+
+// serveSocks5 handles a SOCKS5 CONNECT or UDP ASSOCIATE request.
+func (p *Proxy) serveSocks5(conn net.Conn, br *bufio.Reader) error {
+	// 1. Greeting: only "no authentication" is supported
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5NoAcceptable {
+		return fmt.Errorf("no acceptable authentication method")
+	}
+
+	// 2. Request
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return err
+	}
+	target, err := socks.ReadAddr(br)
+	if err != nil {
+		return err
+	}
+
+	switch req[1] {
+	case socks5CmdConnect:
+		upstream, err := p.dialer.DialContext(withSource(context.Background(), conn.RemoteAddr().String()), "tcp", target.String())
+		if err != nil {
+			writeSocks5Reply(conn, socks5HostUnreachable, nil)
+			return fmt.Errorf("failed to connect to %s: %w", target, err)
+		}
+		defer upstream.Close()
+		if err := writeSocks5Reply(conn, socks5Succeeded, nil); err != nil {
+			return err
+		}
+		relay(newBufferedConn(conn, br), upstream)
+		return nil
+	case socks5CmdAssociate:
+		// Listen for the client's datagrams on the address it reached us at.
+		host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+		udpConn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			writeSocks5Reply(conn, socks5GeneralFailure, nil)
+			return err
+		}
+		defer udpConn.Close()
+		if err := writeSocks5Reply(conn, socks5Succeeded, socks.ParseAddr(udpConn.LocalAddr().String())); err != nil {
+			return err
+		}
+		go func() {
+			// The association ends when the control connection closes.
+			io.Copy(io.Discard, br)
+			udpConn.Close()
+		}()
+		// Only the client may use the association: datagrams must come from
+		// the address of the control connection, and from the port in the
+		// request unless it is 0.
+		remote, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err != nil {
+			return err
+		}
+		port := binary.BigEndian.Uint16(target[len(target)-2:])
+		p.relaySocks5UDP(udpConn, netip.AddrPortFrom(remote.Addr().Unmap(), port))
+		return nil
+	default:
+		writeSocks5Reply(conn, socks5CmdNotSupported, nil)
+		return fmt.Errorf("unsupported SOCKS5 command %d", req[1])
+	}
+}
+
+// writeSocks5Reply sends a SOCKS5 reply with the given bound address, or
+// 0.0.0.0:0 if bnd is nil.
+func writeSocks5Reply(conn net.Conn, rep byte, bnd socks.Addr) error {
+	if bnd == nil {
+		bnd = socks.Addr{socks.AtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	reply := append([]byte{socks5Version, rep, 0x00}, bnd...)
+	_, err := conn.Write(reply)
+	return err
+}
+
+// relaySocks5UDP relays the datagrams that client sends to udpConn until
+// udpConn is closed; the port of client may be 0 for any. Each destination
+// gets its own outbound packet conn, since some outbounds bind a UDP
+// session to a single destination. It is opened in the background, with
+// the first datagrams queued meanwhile, and released once idle for
+// udpSessionTimeout.
+func (p *Proxy) relaySocks5UDP(udpConn net.PacketConn, client netip.AddrPort) {
+	var (
+		mu         sync.Mutex
+		clientAddr net.Addr
+		upstreams  = make(map[string]*udpSession)
+		closed     bool
+	)
+	defer func() {
+		mu.Lock()
+		closed = true
+		for _, upstream := range upstreams {
+			if upstream.conn != nil {
+				upstream.conn.Close()
+			}
+		}
+		mu.Unlock()
+	}()
+
+	// serve opens the upstream to dst, sends the datagrams queued for it and
+	// relays its replies to the client.
+	serve := func(dst string, upstream *udpSession) {
+		var conn net.PacketConn
+		defer func() {
+			mu.Lock()
+			if upstreams[dst] == upstream {
+				delete(upstreams, dst)
+			}
+			mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+		conn, err := p.dialer.ListenPacket(withSource(context.Background(), client.String()), dst)
+		if err != nil {
+			log.Printf("SOCKS5 UDP error: %v", err)
+			return
+		}
+		// The queue is emptied before the upstream takes new datagrams
+		// directly, which keeps them in order.
+		for {
+			mu.Lock()
+			if closed || upstreams[dst] != upstream {
+				mu.Unlock()
+				return
+			}
+			pending := upstream.pending
+			upstream.pending = nil
+			if len(pending) == 0 {
+				upstream.conn = conn
+				mu.Unlock()
+				break
+			}
+			mu.Unlock()
+			for _, b := range pending {
+				if _, err := conn.WriteTo(b, upstream.target); err != nil {
+					log.Printf("SOCKS5 UDP error: %v", err)
+					continue
+				}
+				AddBytesSent(int64(len(b)))
+			}
+		}
+
+		rbuf := make([]byte, udpBufSize)
+		for {
+			conn.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+			n, from, err := conn.ReadFrom(rbuf)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) && upstream.idle() < udpSessionTimeout {
+					continue
+				}
+				return
+			}
+			upstream.touch()
+			src := socks.ParseAddr(from.String())
+			if src == nil {
+				continue
+			}
+			AddBytesReceived(int64(n))
+			pkt := make([]byte, 0, 3+len(src)+n)
+			pkt = append(pkt, 0x00, 0x00, 0x00)
+			pkt = append(pkt, src...)
+			pkt = append(pkt, rbuf[:n]...)
+			mu.Lock()
+			to := clientAddr
+			mu.Unlock()
+			udpConn.WriteTo(pkt, to)
+		}
+	}
+
+	buf := make([]byte, udpBufSize)
+	for {
+		n, addr, err := udpConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !fromSocksClient(addr, client) {
+			continue
+		}
+		// Drop fragmented and malformed datagrams.
+		if n < 3 || buf[2] != 0x00 {
+			continue
+		}
+		dst := socks.SplitAddr(buf[3:n])
+		if dst == nil {
+			continue
+		}
+		payload := buf[3+len(dst) : n]
+		key := dst.String()
+
+		mu.Lock()
+		clientAddr = addr
+		upstream, ok := upstreams[key]
+		if !ok {
+			upstream = &udpSession{target: packetAddr(key)}
+			upstreams[key] = upstream
+		}
+		upstream.touch()
+		conn := upstream.conn
+		if conn == nil {
+			if len(upstream.pending) < udpPendingPackets {
+				upstream.pending = append(upstream.pending, bytes.Clone(payload))
+			}
+			if !ok {
+				go serve(key, upstream)
+			}
+			mu.Unlock()
+			continue
+		}
+		mu.Unlock()
+
+		if _, err := conn.WriteTo(payload, upstream.target); err != nil {
+			log.Printf("SOCKS5 UDP error: %v", err)
+			continue
+		}
+		AddBytesSent(int64(len(payload)))
+	}
+}
+
+// fromSocksClient reports whether addr, the source of a datagram, is client.
+// A client port of 0 matches any port.
+func fromSocksClient(addr net.Addr, client netip.AddrPort) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	ap := udpAddr.AddrPort()
+	return ap.Addr().Unmap() == client.Addr() && (client.Port() == 0 || ap.Port() == client.Port())
+}
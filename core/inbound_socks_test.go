@@ -0,0 +1,60 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// TestSocks5UDPOnlyFromClient checks that a UDP association relays the
+// datagrams of its client and drops those of other senders.
+func TestSocks5UDPOnlyFromClient(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	relayConn, echo, client, stranger := listen(), listen(), listen(), listen()
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+	p := &Proxy{dialer: Direct}
+	go p.relaySocks5UDP(relayConn, clientAddr)
+
+	datagram := func(payload string) []byte {
+		pkt := []byte{0, 0, 0}
+		pkt = append(pkt, socks.ParseAddr(echo.LocalAddr().String())...)
+		return append(pkt, payload...)
+	}
+	if _, err := stranger.WriteTo(datagram("stranger"), relayConn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo(datagram("client"), relayConn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	echo.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, from, err := echo.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "client" {
+		t.Fatalf("relayed %q, want only the client's datagram", buf[:n])
+	}
+	if _, err := echo.WriteTo([]byte("reply"), from); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := datagram("reply"); !bytes.Equal(buf[:n], want) {
+		t.Errorf("client got %x, want %x", buf[:n], want)
+	}
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// linuxNet configures interfaces, routes and policy rules of a network
+// namespace over netlink.
+type linuxNet struct {
+	h *netlink.Handle
+}
+
+// newLinuxNet returns a linuxNet for the current network namespace.
+func newLinuxNet() (*linuxNet, error) {
+	h, err := netlink.NewHandle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	return &linuxNet{h: h}, nil
+}
+
+// newLinuxNetAt returns a linuxNet for the network namespace ns, such as a
+// throwaway one created with netns.New.
+func newLinuxNetAt(ns netns.NsHandle) (*linuxNet, error) {
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket in namespace %s: %w", ns, err)
+	}
+	return &linuxNet{h: h}, nil
+}
+
+func (n *linuxNet) Close() {
+	n.h.Close()
+}
+
+// configureLink sets the addresses and MTU of the interface name and
+// brings it up.
+func (n *linuxNet) configureLink(name string, addrs []netip.Prefix, mtu int) error {
+	link, err := n.h.LinkByName(name)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to find interface %s", name), err)
+	}
+	for _, addr := range addrs {
+		if err := n.h.AddrReplace(link, &netlink.Addr{IPNet: prefixIPNet(addr)}); err != nil {
+			return netlinkError(fmt.Sprintf("failed to add address %s to %s", addr, name), err)
+		}
+	}
+	if err := n.h.LinkSetMTU(link, mtu); err != nil {
+		return netlinkError(fmt.Sprintf("failed to set MTU of %s to %d", name, mtu), err)
+	}
+	if err := n.h.LinkSetUp(link); err != nil {
+		return netlinkError(fmt.Sprintf("failed to bring up %s", name), err)
+	}
+	return nil
+}
+
+// addRoutes routes dsts through the interface name in the routing table
+// table, replacing any routes to them there.
+func (n *linuxNet) addRoutes(name string, dsts []netip.Prefix, table int) error {
+	link, err := n.h.LinkByName(name)
+	if err != nil {
+		return netlinkError(fmt.Sprintf("failed to find interface %s", name), err)
+	}
+	for _, dst := range dsts {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       prefixIPNet(dst),
+			Scope:     netlink.SCOPE_LINK,
+			Table:     table,
+		}
+		if err := n.h.RouteReplace(route); err != nil {
+			return netlinkError(fmt.Sprintf("failed to route %s through %s in table %d", dst, name, table), err)
+		}
+	}
+	return nil
+}
+
+// replaceRules installs rules after deleting the rules of both families
+// with priorities from first to last, which are the ones a previous run
+// installed.
+func (n *linuxNet) replaceRules(first, last int, rules []*netlink.Rule) error {
+	if err := n.deleteRules(first, last); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if err := n.h.RuleAdd(r); err != nil {
+			return netlinkError(fmt.Sprintf("failed to add policy rule %s", r), err)
+		}
+	}
+	return nil
+}
+
+// deleteRules deletes the rules of both families with priorities from first
+// to last.
+func (n *linuxNet) deleteRules(first, last int) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := n.h.RuleList(family)
+		if err != nil {
+			return netlinkError("failed to list policy rules", err)
+		}
+		for _, r := range rules {
+			if r.Priority < first || r.Priority > last {
+				continue
+			}
+			if err := n.h.RuleDel(&r); err != nil && !errors.Is(err, unix.ENOENT) {
+				return netlinkError(fmt.Sprintf("failed to delete policy rule %s", r), err)
+			}
+		}
+	}
+	return nil
+}
+
+// newRule returns a rule of the family of dst, or of family if dst is not
+// valid, looking up table at priority.
+func newRule(priority, table, family int, dst netip.Prefix) *netlink.Rule {
+	r := netlink.NewRule()
+	r.Priority = priority
+	r.Table = table
+	r.Family = family
+	if dst.IsValid() {
+		r.Dst = prefixIPNet(dst)
+		r.Family = netlink.FAMILY_V4
+		if dst.Addr().Is6() {
+			r.Family = netlink.FAMILY_V6
+		}
+	}
+	return r
+}
+
+// netlinkError describes a failed netlink request, pointing out missing
+// privileges, which are the usual cause.
+func netlinkError(msg string, err error) error {
+	if errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("%s: %w (NekoGo needs CAP_NET_ADMIN, e.g. by running as root)", msg, err)
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+func prefixIPNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   p.Addr().AsSlice(),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// withTestNetns runs f in a throwaway network namespace, with a linuxNet for
+// it. It needs root, and is skipped without it.
+func withTestNetns(t *testing.T, f func(n *linuxNet)) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create a network namespace")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("cannot create a network namespace: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(orig)
+
+	n, err := newLinuxNetAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	f(n)
+}
+
+func TestConfigureTUNRoutes(t *testing.T) {
+	withTestNetns(t, func(n *linuxNet) {
+		const name = "nekogo-test"
+		// A persistent TUN device stands in for the one water creates.
+		link := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name}, Mode: netlink.TUNTAP_MODE_TUN}
+		if err := n.h.LinkAdd(link); err != nil {
+			t.Skipf("cannot create a TUN device: %v", err)
+		}
+		prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.85.2/24"), netip.MustParsePrefix("fdfe:dcba:9876::2/64")}
+		if err := n.configureLink(name, prefixes, 1400); err != nil {
+			t.Fatal(err)
+		}
+		server := netip.MustParseAddr("203.0.113.7")
+		exclude := netip.MustParsePrefix("198.51.100.0/24")
+		r := tunRouting{autoRoute: true, exclude: []netip.Prefix{exclude}, bypass: []netip.Addr{server}}
+		// Configuring twice replaces the rules of the first run.
+		for range 2 {
+			if err := configureTUNRoutes(n, name, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		l, err := n.h.LinkByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Attrs().MTU != 1400 {
+			t.Errorf("MTU = %d, want 1400", l.Attrs().MTU)
+		}
+		routes, err := n.h.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: tunRouteTable}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dsts []string
+		for _, route := range routes {
+			dsts = append(dsts, route.Dst.String())
+		}
+		for _, want := range []string{"0.0.0.0/0", "::/0"} {
+			if !slices.Contains(dsts, want) {
+				t.Errorf("table %d routes %v, missing %s", tunRouteTable, dsts, want)
+			}
+		}
+
+		rules := tunRules(t, n)
+		if len(rules) != 8 {
+			t.Errorf("got %d rules, want 8: %v", len(rules), rules)
+		}
+		var sawServer, sawExclude bool
+		for _, rule := range rules {
+			switch {
+			case rule.Dst != nil && rule.Dst.String() == netip.PrefixFrom(server, 32).String():
+				sawServer = rule.Priority == tunRuleBypass && rule.Table == unix.RT_TABLE_MAIN
+			case rule.Dst != nil && rule.Dst.String() == exclude.String():
+				sawExclude = rule.Priority == tunRuleExclude && rule.Table == unix.RT_TABLE_MAIN
+			}
+		}
+		if !sawServer || !sawExclude {
+			t.Errorf("server or excluded route not routed by the main table: %v", rules)
+		}
+
+		if err := n.deleteRules(tunRuleBypass, tunRuleFallback); err != nil {
+			t.Fatal(err)
+		}
+		if rules := tunRules(t, n); len(rules) != 0 {
+			t.Errorf("rules left after deleteRules: %v", rules)
+		}
+	})
+}
+
+// tunRules returns the policy rules of both families that TUN mode owns.
+func tunRules(t *testing.T, n *linuxNet) []netlink.Rule {
+	var owned []netlink.Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := n.h.RuleList(family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rules {
+			if r.Priority >= tunRuleBypass && r.Priority <= tunRuleFallback {
+				owned = append(owned, r)
+			}
+		}
+	}
+	return owned
+}
+
+func TestConfigureTUNRoutesIPv4Only(t *testing.T) {
+	withTestNetns(t, func(n *linuxNet) {
+		const name = "nekogo-test"
+		link := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name}, Mode: netlink.TUNTAP_MODE_TUN}
+		if err := n.h.LinkAdd(link); err != nil {
+			t.Skipf("cannot create a TUN device: %v", err)
+		}
+		if err := n.configureLink(name, []netip.Prefix{netip.MustParsePrefix("10.0.85.2/24")}, 1500); err != nil {
+			t.Fatal(err)
+		}
+		r := tunRouting{
+			autoRoute: true,
+			exclude:   slices.Clone(lanPrefixes),
+			bypass:    []netip.Addr{netip.MustParseAddr("203.0.113.7"), netip.MustParseAddr("2001:db8::7")},
+		}
+		r.dropIPv6()
+		if err := configureTUNRoutes(n, name, r); err != nil {
+			t.Fatal(err)
+		}
+
+		routes, err := n.h.RouteListFiltered(netlink.FAMILY_V6, &netlink.Route{Table: tunRouteTable}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(routes) != 0 {
+			t.Errorf("IPv6 routes in table %d: %v", tunRouteTable, routes)
+		}
+		for _, rule := range tunRules(t, n) {
+			if rule.Family == netlink.FAMILY_V6 {
+				t.Errorf("IPv6 rule added: %v", rule)
+			}
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	netStackNICID = 1
+
+	// tcpMaxInFlight caps the number of half-open connections the stack
+	// will track while their upstream is being dialed.
+	tcpMaxInFlight = 2048
+)
+
+// TCPHandler is called for every TCP connection accepted by the userspace
+// stack. dst is the address the application originally tried to reach.
+type TCPHandler func(conn net.Conn, dst *net.TCPAddr)
+
+// NetStack terminates TCP sessions coming from the TUN device inside a
+// gVisor userspace network stack, so that each flow can be relayed as a
+// regular net.Conn instead of as individual packets.
+type NetStack struct {
+	stack  *stack.Stack
+	ep     *channel.Endpoint
+	cancel context.CancelFunc
+}
+
+// NewNetStack creates the userspace stack and starts writing the packets it
+// produces back to ifce.
+func NewNetStack(ifce TUNDevice, mtu uint32, handler TCPHandler) (*NetStack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+
+	ep := channel.New(512, mtu, "")
+	if err := s.CreateNIC(netStackNICID, ep); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to create NIC: %s", err)
+	}
+	// The stack must accept packets for any destination and reply from any
+	// source, since it stands in for every host on the internet.
+	if err := s.SetPromiscuousMode(netStackNICID, true); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to enable promiscuous mode: %s", err)
+	}
+	if err := s.SetSpoofing(netStackNICID, true); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to enable spoofing: %s", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: netStackNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: netStackNICID},
+	})
+
+	sack := tcpip.TCPSACKEnabled(true)
+	s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
+
+	fwd := tcp.NewForwarder(s, 0, tcpMaxInFlight, func(r *tcp.ForwarderRequest) {
+		id := r.ID()
+		var wq waiter.Queue
+		tep, err := r.CreateEndpoint(&wq)
+		if err != nil {
+			log.Printf("TUN TCP endpoint error: %s", err)
+			r.Complete(true)
+			return
+		}
+		r.Complete(false)
+		tep.SocketOptions().SetKeepAlive(true)
+
+		conn := gonet.NewTCPConn(&wq, tep)
+		dst := &net.TCPAddr{IP: net.IP(id.LocalAddress.AsSlice()), Port: int(id.LocalPort)}
+		go handler(conn, dst)
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, fwd.HandlePacket)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ns := &NetStack{stack: s, ep: ep, cancel: cancel}
+	go ns.writeLoop(ctx, ifce)
+	return ns, nil
+}
+
+// InjectPacket feeds a raw IP packet read from the TUN device into the stack.
+func (ns *NetStack) InjectPacket(pkt []byte) {
+	var proto tcpip.NetworkProtocolNumber
+	switch header.IPVersion(pkt) {
+	case header.IPv4Version:
+		proto = header.IPv4ProtocolNumber
+	case header.IPv6Version:
+		proto = header.IPv6ProtocolNumber
+	default:
+		return
+	}
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(pkt),
+	})
+	ns.ep.InjectInbound(proto, pkb)
+	pkb.DecRef()
+}
+
+// writeLoop copies packets generated by the stack back to the TUN device.
+func (ns *NetStack) writeLoop(ctx context.Context, ifce TUNDevice) {
+	for {
+		pkb := ns.ep.ReadContext(ctx)
+		if pkb == nil {
+			return
+		}
+		view := pkb.ToView()
+		if _, err := ifce.Write(view.AsSlice()); err != nil {
+			log.Printf("Failed to write packet to TUN: %v", err)
+		}
+		view.Release()
+		pkb.DecRef()
+	}
+}
+
+// Close tears down the stack and all connections still attached to it.
+func (ns *NetStack) Close() {
+	ns.cancel()
+	ns.ep.Close()
+	ns.stack.Close()
+	ns.stack.Wait()
+}
@@ -0,0 +1,384 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+// handshakeTimeout bounds protocol handshakes with proxy servers when the
+// caller's context has no deadline of its own.
+const handshakeTimeout = 10 * time.Second
+
+// Dialer is an outbound: it opens connections to destinations through a
+// proxy server, or directly. Addresses are "host:port" strings whose host
+// may be a domain name, which is then resolved on the far side.
+type Dialer interface {
+	// DialContext connects to addr over network ("tcp" for proxy outbounds).
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	// ListenPacket opens a UDP session whose first destination is addr.
+	// WriteTo and ReadFrom on the returned conn take and return remote
+	// destination addresses; outbounds that can only carry one destination
+	// per session bind to addr.
+	ListenPacket(ctx context.Context, addr string) (net.PacketConn, error)
+}
+
+// OutboundFactory creates the Dialer for a server of a registered type.
+type OutboundFactory func(server config.ServerConfig) (Dialer, error)
+
+var (
+	outboundsMu sync.RWMutex
+	outbounds   = make(map[string]OutboundFactory)
+)
+
+// RegisterOutbound makes an outbound protocol available for servers whose
+// ServerConfig.Type is serverType.
+func RegisterOutbound(serverType string, factory OutboundFactory) {
+	outboundsMu.Lock()
+	defer outboundsMu.Unlock()
+	outbounds[serverType] = factory
+}
+
+// NewOutbound creates the Dialer for server using the factory registered for
+// its type.
+func NewOutbound(server config.ServerConfig) (Dialer, error) {
+	outboundsMu.RLock()
+	factory, ok := outbounds[server.Type]
+	outboundsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported server type: %s", server.Type)
+	}
+	return factory(server)
+}
+
+// chainable is implemented by outbounds that can reach their server through
+// another outbound instead of connecting to it directly.
+type chainable interface {
+	setDialer(d Dialer) error
+}
+
+// NewChainedOutbound creates the Dialer for cfg.Servers[index]. A server
+// with a detour is connected to through the outbound of its detour server,
+// which may have a detour of its own.
+func NewChainedOutbound(cfg *config.AppConfig, index int) (Dialer, error) {
+	chain, err := cfg.DetourChain(index)
+	if err != nil {
+		return nil, err
+	}
+	hops := make([]Dialer, 0, len(chain))
+	dialer := Direct
+	for i := len(chain) - 1; i >= 0; i-- {
+		d, err := NewOutbound(chain[i])
+		if err == nil && i < len(chain)-1 {
+			if c, ok := d.(chainable); ok {
+				err = c.setDialer(dialer)
+			} else {
+				err = fmt.Errorf("%s servers cannot be used with a detour", chain[i].Type)
+			}
+		}
+		if err != nil {
+			for _, hop := range hops {
+				closeOutbound(hop)
+			}
+			return nil, fmt.Errorf("server %s: %w", chain[i].Name, err)
+		}
+		hops = append(hops, d)
+		dialer = d
+	}
+	if len(hops) == 1 {
+		return dialer, nil
+	}
+	return &chainedDialer{Dialer: dialer, hops: hops}, nil
+}
+
+// chainedDialer is the outbound of the last server in a detour chain. It
+// closes every outbound of the chain.
+type chainedDialer struct {
+	Dialer
+	hops []Dialer
+}
+
+func (d *chainedDialer) Close() error {
+	for _, hop := range d.hops {
+		closeOutbound(hop)
+	}
+	return nil
+}
+
+// closeOutbound releases what an outbound holds beyond its connections,
+// such as plugin processes, if it holds anything.
+func closeOutbound(d Dialer) {
+	if c, ok := d.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// serverAddr returns the "host:port" address of a proxy server.
+func serverAddr(server config.ServerConfig) string {
+	return net.JoinHostPort(server.Address, strconv.Itoa(server.Port))
+}
+
+// isTCP reports whether network is one of the TCP networks.
+func isTCP(network string) bool {
+	return strings.HasPrefix(network, "tcp")
+}
+
+// handshakeDeadline applies the deadline of ctx, or handshakeTimeout, to conn
+// while a protocol handshake runs. The returned func clears it again.
+func handshakeDeadline(ctx context.Context, conn net.Conn) func() {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	return func() { conn.SetDeadline(time.Time{}) }
+}
+
+// Direct connects to destinations without any proxy. Domain names are
+// resolved by the DNS of the running session if it has one, so that they
+// get real addresses in fake-IP mode, and by the system otherwise.
+var Direct Dialer = &directDialer{dialer: net.Dialer{Control: markSocket, Resolver: systemResolver}}
+
+// systemResolver is the system's resolver with its sockets marked like
+// Direct's, so that its queries leave without passing through TUN mode.
+var systemResolver = &net.Resolver{
+	PreferGo: true,
+	Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		d := net.Dialer{Control: markSocket}
+		return d.DialContext(ctx, network, address)
+	},
+}
+
+// directDNS is the DNS of the running session, if any, which Direct
+// resolves with.
+var directDNS atomic.Pointer[DNS]
+
+func setDirectDNS(old, next *DNS) {
+	directDNS.CompareAndSwap(old, next)
+}
+
+type systemResolverKey struct{}
+
+// withSystemResolver makes Direct resolve with the system resolver. DNS
+// upstreams dial with it, since resolving the names of their servers, or of
+// the proxy servers they go through, with directDNS would loop.
+func withSystemResolver(ctx context.Context) context.Context {
+	return context.WithValue(ctx, systemResolverKey{}, true)
+}
+
+func usesSystemResolver(ctx context.Context) bool {
+	return ctx.Value(systemResolverKey{}) != nil
+}
+
+type directDialer struct {
+	dialer net.Dialer
+}
+
+func (d *directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if usesSystemResolver(ctx) {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := lookupDirect(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, a := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, a)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// lookupDirect resolves the host of addr with directDNS, returning an
+// address for each of its IPs. addr is returned as it is if it has no
+// domain name or there is no directDNS.
+func lookupDirect(ctx context.Context, addr string) ([]string, error) {
+	dns := directDNS.Load()
+	if dns == nil {
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return []string{addr}, nil
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return []string{addr}, nil
+	}
+	ips, err := dns.LookupIP(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return addrs, nil
+}
+
+func (d *directDialer) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: markSocket}
+	pc, err := lc.ListenPacket(ctx, "udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &directPacketConn{PacketConn: pc, system: usesSystemResolver(ctx)}, nil
+}
+
+// directPacketConn resolves destinations that are not already UDP addresses,
+// so callers may pass domain names to WriteTo.
+type directPacketConn struct {
+	net.PacketConn
+	system bool // resolve with the system resolver rather than directDNS
+}
+
+func (c *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if udpAddr, err = c.resolve(addr.String()); err != nil {
+			return 0, err
+		}
+	}
+	return c.PacketConn.WriteTo(b, udpAddr)
+}
+
+// resolve resolves the host of addr with directDNS, if c uses it, and the
+// system resolver otherwise.
+func (c *directPacketConn) resolve(addr string) (*net.UDPAddr, error) {
+	ctx := context.Background()
+	if !c.system {
+		addrs, err := lookupDirect(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = addrs[0]
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+	ips, err := systemResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ips[0].Unmap(), uint16(port))), nil
+}
+
+// packetAddr is a UDP destination given as "host:port", where host may be a
+// domain name left for the outbound to resolve.
+type packetAddr string
+
+func (a packetAddr) Network() string { return "udp" }
+func (a packetAddr) String() string  { return string(a) }
+
+// Outbounds creates and holds the outbounds of the servers and groups of a
+// config, which are referred to by name. Each is created when first used
+// and shared from then on.
+type Outbounds struct {
+	cfg *config.AppConfig
+
+	mu      sync.Mutex
+	servers map[int]Dialer
+	groups  map[string]*Group
+}
+
+func NewOutbounds(cfg *config.AppConfig) *Outbounds {
+	return &Outbounds{
+		cfg:     cfg,
+		servers: make(map[int]Dialer),
+		groups:  make(map[string]*Group),
+	}
+}
+
+// Active returns the outbound of the active group if one is set, and of the
+// active server otherwise.
+func (o *Outbounds) Active() (Dialer, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cfg.ActiveGroup != "" {
+		return o.get(o.cfg.ActiveGroup)
+	}
+	return o.server(o.cfg.ActiveIndex)
+}
+
+// Get returns the outbound of the server or group named name.
+func (o *Outbounds) Get(name string) (Dialer, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.get(name)
+}
+
+// Group returns the group named name if it has been created.
+func (o *Outbounds) Group(name string) (*Group, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	g, ok := o.groups[name]
+	return g, ok
+}
+
+func (o *Outbounds) get(name string) (Dialer, error) {
+	if g, ok := o.groups[name]; ok {
+		return g, nil
+	}
+	if i := o.cfg.ServerIndex(name); i >= 0 {
+		return o.server(i)
+	}
+	gc, ok := o.cfg.FindGroup(name)
+	if !ok {
+		return nil, fmt.Errorf("no server or group named %q", name)
+	}
+	members := make([]groupMember, len(gc.Members))
+	for i, m := range gc.Members {
+		d, err := o.get(m)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", name, err)
+		}
+		members[i] = groupMember{name: m, dialer: d}
+	}
+	g := newGroup(gc, members)
+	o.groups[name] = g
+	return g, nil
+}
+
+func (o *Outbounds) server(i int) (Dialer, error) {
+	if d, ok := o.servers[i]; ok {
+		return d, nil
+	}
+	d, err := NewChainedOutbound(o.cfg, i)
+	if err != nil {
+		return nil, err
+	}
+	o.servers[i] = d
+	return d, nil
+}
+
+// Close closes every outbound created so far.
+func (o *Outbounds) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, g := range o.groups {
+		g.Close()
+	}
+	for _, d := range o.servers {
+		closeOutbound(d)
+	}
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+func init() {
+	RegisterOutbound("http", func(server config.ServerConfig) (Dialer, error) {
+		return NewHttpOutbound(server)
+	})
+}
+
+// HttpOutbound tunnels TCP connections through an HTTP proxy using CONNECT.
+// The proxy may be reached over TLS and may require Basic authentication.
+type HttpOutbound struct {
+	Server config.ServerConfig
+	dialer Dialer
+}
+
+func NewHttpOutbound(server config.ServerConfig) (*HttpOutbound, error) {
+	if err := checkSecurity(server); err != nil {
+		return nil, err
+	}
+	return &HttpOutbound{Server: server, dialer: Direct}, nil
+}
+
+func (h *HttpOutbound) setDialer(d Dialer) error {
+	h.dialer = d
+	return nil
+}
+
+func (h *HttpOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !isTCP(network) {
+		return nil, fmt.Errorf("unsupported network for HTTP proxy: %s", network)
+	}
+	conn, err := dialSecure(ctx, h.dialer, h.Server, []string{"http/1.1"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial HTTP proxy: %w", err)
+	}
+
+	clearDeadline := handshakeDeadline(ctx, conn)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.Server.Username != "" {
+		auth := h.Server.Username + ":" + h.Server.Password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+	}
+	clearDeadline()
+	return newBufferedConn(conn, br), nil
+}
+
+func (h *HttpOutbound) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	return nil, fmt.Errorf("UDP forwarding is not supported by HTTP proxies")
+}
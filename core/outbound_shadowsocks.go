@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	ss "github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func init() {
+	RegisterOutbound("shadowsocks", func(server config.ServerConfig) (Dialer, error) {
+		return NewShadowsocksOutbound(server)
+	})
+}
+
+// ShadowsocksOutbound connects through a Shadowsocks server using either a
+// legacy AEAD cipher or a 2022-blake3 one. With a SIP003 plugin configured,
+// TCP goes through the plugin while UDP still goes to the server directly.
+type ShadowsocksOutbound struct {
+	Server config.ServerConfig
+	Cipher ss.Cipher // legacy ciphers only
+	ss2022 *ss2022Cipher
+	plugin *sip003Plugin
+	dialer Dialer
+}
+
+func NewShadowsocksOutbound(server config.ServerConfig) (*ShadowsocksOutbound, error) {
+	s := &ShadowsocksOutbound{Server: server, dialer: Direct}
+	var err error
+	if isSS2022(server.Method) {
+		s.ss2022, err = newSS2022Cipher(server.Method, server.Password)
+	} else {
+		s.Cipher, err = ss.PickCipher(server.Method, nil, server.Password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	if server.Plugin != "" {
+		s.plugin = newSIP003Plugin(server)
+	}
+	return s, nil
+}
+
+func (s *ShadowsocksOutbound) setDialer(d Dialer) error {
+	if s.plugin != nil {
+		return fmt.Errorf("servers with a SIP003 plugin cannot be used with a detour")
+	}
+	s.dialer = d
+	return nil
+}
+
+func (s *ShadowsocksOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !isTCP(network) {
+		return nil, fmt.Errorf("unsupported network for Shadowsocks: %s", network)
+	}
+	tgt := socks.ParseAddr(addr)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid target address: %s", addr)
+	}
+
+	var rawConn net.Conn
+	var err error
+	if s.plugin != nil {
+		rawConn, err = s.plugin.DialContext(ctx)
+	} else {
+		rawConn, err = s.dialer.DialContext(ctx, "tcp", serverAddr(s.Server))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial Shadowsocks: %w", err)
+	}
+	if s.ss2022 != nil {
+		conn, err := s.ss2022.dialStream(rawConn, tgt)
+		if err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	conn := &ssStreamConn{Conn: s.Cipher.StreamConn(rawConn), raw: rawConn}
+
+	// The target address is sent as the first bytes of the stream.
+	if _, err := conn.Write(tgt); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write addr: %w", err)
+	}
+	return conn, nil
+}
+
+// ssStreamConn is a Shadowsocks stream, whose cipher's conn hides the
+// CloseWrite of the connection underneath.
+type ssStreamConn struct {
+	net.Conn
+	raw net.Conn
+}
+
+func (c *ssStreamConn) CloseWrite() error {
+	return forwardCloseWrite(c.raw)
+}
+
+func (s *ShadowsocksOutbound) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	srvAddr, err := net.ResolveUDPAddr("udp", serverAddr(s.Server))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve Shadowsocks server: %w", err)
+	}
+	pc, err := s.dialer.ListenPacket(ctx, srvAddr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket for Shadowsocks: %w", err)
+	}
+	if s.ss2022 != nil {
+		conn, err := s.ss2022.packetConn(pc, srvAddr)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return &ssPacketConn{PacketConn: s.Cipher.PacketConn(pc), server: srvAddr}, nil
+}
+
+// Close stops the SIP003 plugin, if any.
+func (s *ShadowsocksOutbound) Close() error {
+	if s.plugin != nil {
+		return s.plugin.Close()
+	}
+	return nil
+}
+
+// ssPacketConn prefixes every datagram with its target address, as the
+// Shadowsocks UDP relay expects, and strips it from replies.
+type ssPacketConn struct {
+	net.PacketConn
+	server *net.UDPAddr
+}
+
+func (c *ssPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, fmt.Errorf("invalid target address: %s", addr)
+	}
+	pkt := make([]byte, 0, len(tgt)+len(b))
+	pkt = append(pkt, tgt...)
+	pkt = append(pkt, b...)
+	if _, err := c.PacketConn.WriteTo(pkt, c.server); err != nil {
+		return 0, fmt.Errorf("failed to write payload to SS UDP: %w", err)
+	}
+	return len(b), nil
+}
+
+func (c *ssPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := udpBufPool.Get().(*[udpBufSize]byte)
+	defer udpBufPool.Put(buf)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		payload, addr, err := splitPacketAddr(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// splitPacketAddr splits a datagram that starts with a SOCKS address into
+// its payload and source address.
+func splitPacketAddr(b []byte) ([]byte, net.Addr, error) {
+	src := socks.SplitAddr(b)
+	if src == nil {
+		return nil, nil, fmt.Errorf("invalid address header")
+	}
+	addr, err := net.ResolveUDPAddr("udp", src.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return b[len(src):], addr, nil
+}
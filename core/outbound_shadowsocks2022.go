@@ -0,0 +1,569 @@
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// Shadowsocks 2022 (SIP022) header types and limits.
+const (
+	ss2022ClientType = 0
+	ss2022ServerType = 1
+	ss2022MaxPadding = 900
+	ss2022MaxChunk   = 0xFFFF
+	ss2022MaxSkew    = 30 * time.Second // allowed clock difference to the server
+	ss2022SaltTTL    = 60 * time.Second // how long seen salts are remembered
+)
+
+// isSS2022 reports whether method is one of the 2022-blake3 ciphers.
+func isSS2022(method string) bool {
+	return strings.HasPrefix(method, "2022-blake3-")
+}
+
+// ss2022Cipher holds the keys of a 2022-blake3 cipher. Its password is a
+// base64 PSK, or, for servers with several users (SIP023), a ":"-separated
+// list of identity PSKs followed by the user's PSK.
+type ss2022Cipher struct {
+	keyLen  int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	psks    [][]byte
+
+	// UDP packets of the AES ciphers have their header encrypted with the
+	// first PSK; replies come back encrypted with the user PSK. The
+	// ChaCha20 cipher seals whole packets with XChaCha20-Poly1305 instead.
+	udpEncrypt, udpDecrypt cipher.Block
+	udpAEAD                cipher.AEAD
+}
+
+func newSS2022Cipher(method, password string) (*ss2022Cipher, error) {
+	c := &ss2022Cipher{}
+	switch method {
+	case "2022-blake3-aes-128-gcm":
+		c.keyLen, c.newAEAD = 16, newAESGCM
+	case "2022-blake3-aes-256-gcm":
+		c.keyLen, c.newAEAD = 32, newAESGCM
+	case "2022-blake3-chacha20-poly1305":
+		c.keyLen, c.newAEAD = 32, chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("unsupported cipher: %s", method)
+	}
+	for _, s := range strings.Split(password, ":") {
+		psk, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(psk) != c.keyLen {
+			return nil, fmt.Errorf("%s requires base64 keys of %d bytes", method, c.keyLen)
+		}
+		c.psks = append(c.psks, psk)
+	}
+
+	var err error
+	if method == "2022-blake3-chacha20-poly1305" {
+		if len(c.psks) > 1 {
+			return nil, fmt.Errorf("%s does not support identity keys", method)
+		}
+		c.udpAEAD, err = chacha20poly1305.NewX(c.psks[0])
+		return c, err
+	}
+	if c.udpEncrypt, err = aes.NewCipher(c.psks[0]); err != nil {
+		return nil, err
+	}
+	c.udpDecrypt, err = aes.NewCipher(c.userPSK())
+	return c, err
+}
+
+// userPSK returns the PSK that session keys are derived from.
+func (c *ss2022Cipher) userPSK() []byte {
+	return c.psks[len(c.psks)-1]
+}
+
+// sessionAEAD returns the AEAD keyed with the session subkey for salt, which
+// is a stream salt or a UDP session ID.
+func (c *ss2022Cipher) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, c.keyLen)
+	blake3.DeriveKey(key, "shadowsocks 2022 session subkey", append(append([]byte(nil), c.userPSK()...), salt...))
+	return c.newAEAD(key)
+}
+
+// pskHash returns the first 16 bytes of the BLAKE3 hash of the PSK after
+// psks[i], which identity headers carry.
+func (c *ss2022Cipher) pskHash(i int) []byte {
+	h := blake3.Sum512(c.psks[i+1])
+	return h[:aes.BlockSize]
+}
+
+// appendIdentityHeaders appends the SIP023 identity headers of a stream to
+// dst, one for each identity PSK.
+func (c *ss2022Cipher) appendIdentityHeaders(dst, salt []byte) ([]byte, error) {
+	for i, psk := range c.psks[:len(c.psks)-1] {
+		key := make([]byte, c.keyLen)
+		blake3.DeriveKey(key, "shadowsocks 2022 identity subkey", append(append([]byte(nil), psk...), salt...))
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		header := make([]byte, aes.BlockSize)
+		block.Encrypt(header, c.pskHash(i))
+		dst = append(dst, header...)
+	}
+	return dst, nil
+}
+
+// ss2022Timestamp returns the header timestamp for now.
+func ss2022Timestamp() uint64 {
+	return uint64(time.Now().Unix())
+}
+
+// checkTimestamp rejects headers whose timestamp is too far from our clock,
+// which together with the salt pools prevents replays.
+func checkTimestamp(ts uint64) error {
+	skew := time.Since(time.Unix(int64(ts), 0))
+	if skew > ss2022MaxSkew || skew < -ss2022MaxSkew {
+		return fmt.Errorf("Shadowsocks 2022 timestamp is off by %s", skew.Round(time.Second))
+	}
+	return nil
+}
+
+// ss2022Salts holds the response salts seen within ss2022SaltTTL. A salt
+// seen twice means the response was replayed.
+var ss2022Salts = &saltPool{seen: make(map[string]time.Time)}
+
+type saltPool struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	purge time.Time
+}
+
+// add records salt and reports whether it had not been seen before.
+func (p *saltPool) add(salt []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.After(p.purge) {
+		for s, expiry := range p.seen {
+			if now.After(expiry) {
+				delete(p.seen, s)
+			}
+		}
+		p.purge = now.Add(ss2022SaltTTL)
+	}
+	if expiry, ok := p.seen[string(salt)]; ok && now.Before(expiry) {
+		return false
+	}
+	p.seen[string(salt)] = now.Add(ss2022SaltTTL)
+	return true
+}
+
+// dialStream starts a Shadowsocks 2022 stream to tgt over conn. The request
+// header is sent right away, padded since it carries no payload.
+func (c *ss2022Cipher) dialStream(conn net.Conn, tgt socks.Addr) (net.Conn, error) {
+	salt := make([]byte, c.keyLen)
+	rand.Read(salt)
+	aead, err := c.sessionAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	writer := &ss2022ChunkStream{aead: aead, nonce: make([]byte, aead.NonceSize())}
+
+	padding := 1 + mrand.IntN(ss2022MaxPadding)
+	varHeader := make([]byte, 0, len(tgt)+2+padding)
+	varHeader = append(varHeader, tgt...)
+	varHeader = binary.BigEndian.AppendUint16(varHeader, uint16(padding))
+	varHeader = append(varHeader, make([]byte, padding)...)
+
+	fixedHeader := []byte{ss2022ClientType}
+	fixedHeader = binary.BigEndian.AppendUint64(fixedHeader, ss2022Timestamp())
+	fixedHeader = binary.BigEndian.AppendUint16(fixedHeader, uint16(len(varHeader)))
+
+	req := append([]byte(nil), salt...)
+	if req, err = c.appendIdentityHeaders(req, salt); err != nil {
+		return nil, err
+	}
+	req = writer.seal(req, fixedHeader)
+	req = writer.seal(req, varHeader)
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to write Shadowsocks request: %w", err)
+	}
+	return &ss2022Conn{Conn: conn, cipher: c, reqSalt: salt, writer: writer}, nil
+}
+
+// ss2022Conn carries a Shadowsocks 2022 stream. The response header is read
+// and checked by the first Read.
+type ss2022Conn struct {
+	net.Conn
+	cipher  *ss2022Cipher
+	reqSalt []byte
+
+	wmu    sync.Mutex
+	writer *ss2022ChunkStream
+
+	once   sync.Once
+	err    error
+	reader *ss2022ChunkStream
+	rbuf   []byte
+}
+
+func (c *ss2022Conn) Read(b []byte) (int, error) {
+	c.once.Do(func() { c.err = c.readResponseHeader() })
+	if c.err != nil {
+		return 0, c.err
+	}
+	for len(c.rbuf) == 0 {
+		chunk, err := c.reader.openChunk(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf = chunk
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *ss2022Conn) readResponseHeader() error {
+	salt := make([]byte, c.cipher.keyLen)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	if !ss2022Salts.add(salt) {
+		return fmt.Errorf("replayed Shadowsocks 2022 response")
+	}
+	aead, err := c.cipher.sessionAEAD(salt)
+	if err != nil {
+		return err
+	}
+	c.reader = &ss2022ChunkStream{aead: aead, nonce: make([]byte, aead.NonceSize())}
+
+	header, err := c.reader.open(c.Conn, 1+8+len(c.reqSalt)+2)
+	if err != nil {
+		return err
+	}
+	if header[0] != ss2022ServerType {
+		return fmt.Errorf("invalid Shadowsocks 2022 response header")
+	}
+	if err := checkTimestamp(binary.BigEndian.Uint64(header[1:])); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[9:9+len(c.reqSalt)], c.reqSalt) {
+		return fmt.Errorf("Shadowsocks 2022 response does not match the request")
+	}
+	// The header is followed by the first payload chunk, without a length
+	// chunk of its own.
+	c.rbuf, err = c.reader.open(c.Conn, int(binary.BigEndian.Uint16(header[9+len(c.reqSalt):])))
+	return err
+}
+
+func (c *ss2022Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		size := min(len(b), ss2022MaxChunk)
+		if _, err := c.Conn.Write(c.writer.sealChunk(nil, b[:size])); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite half-closes the underlying stream if it supports it.
+func (c *ss2022Conn) CloseWrite() error {
+	return forwardCloseWrite(c.Conn)
+}
+
+// ss2022ChunkStream encodes or decodes one direction of a Shadowsocks 2022
+// stream: chunks made of a sealed 16-bit length and the sealed payload, with
+// a little-endian counter as the nonce.
+type ss2022ChunkStream struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func (s *ss2022ChunkStream) nextNonce() []byte {
+	nonce := append([]byte(nil), s.nonce...)
+	for i := range s.nonce {
+		s.nonce[i]++
+		if s.nonce[i] != 0 {
+			break
+		}
+	}
+	return nonce
+}
+
+// seal appends b to dst as a single sealed block.
+func (s *ss2022ChunkStream) seal(dst, b []byte) []byte {
+	return s.aead.Seal(dst, s.nextNonce(), b, nil)
+}
+
+// sealChunk appends payload to dst as a chunk.
+func (s *ss2022ChunkStream) sealChunk(dst, payload []byte) []byte {
+	dst = s.seal(dst, binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+	return s.seal(dst, payload)
+}
+
+// open reads a sealed block of size bytes from r.
+func (s *ss2022ChunkStream) open(r io.Reader, size int) ([]byte, error) {
+	buf := make([]byte, size+s.aead.Overhead())
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	b, err := s.aead.Open(buf[:0], s.nextNonce(), buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt Shadowsocks chunk: %w", err)
+	}
+	return b, nil
+}
+
+// openChunk reads the next chunk from r and returns its payload.
+func (s *ss2022ChunkStream) openChunk(r io.Reader) ([]byte, error) {
+	length, err := s.open(r, 2)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(r, int(binary.BigEndian.Uint16(length)))
+}
+
+// ss2022PacketConn is a Shadowsocks 2022 UDP session. Each datagram carries
+// the session ID and a packet ID, which the receiving side checks against
+// a sliding window to drop replays.
+type ss2022PacketConn struct {
+	net.PacketConn
+	cipher *ss2022Cipher
+	server *net.UDPAddr
+
+	sessionID uint64
+	aead      cipher.AEAD // AES ciphers only
+
+	wmu      sync.Mutex
+	packetID uint64
+
+	rmu      sync.Mutex
+	remote   ss2022RemoteSession
+	previous ss2022RemoteSession // kept while the server switches sessions
+}
+
+// ss2022RemoteSession is a server-side UDP session seen in replies.
+type ss2022RemoteSession struct {
+	id     uint64
+	aead   cipher.AEAD
+	window replayWindow
+	fresh  bool // not yet accepted
+}
+
+func (c *ss2022Cipher) packetConn(pc net.PacketConn, server *net.UDPAddr) (net.PacketConn, error) {
+	conn := &ss2022PacketConn{PacketConn: pc, cipher: c, server: server}
+	var id [8]byte
+	rand.Read(id[:])
+	conn.sessionID = binary.BigEndian.Uint64(id[:])
+	if c.udpAEAD == nil {
+		var err error
+		if conn.aead, err = c.sessionAEAD(id[:]); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *ss2022PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, fmt.Errorf("invalid target address: %s", addr)
+	}
+	c.wmu.Lock()
+	c.packetID++
+	packetID := c.packetID
+	c.wmu.Unlock()
+
+	header := binary.BigEndian.AppendUint64(nil, c.sessionID)
+	header = binary.BigEndian.AppendUint64(header, packetID)
+
+	// Pad DNS queries, which are short and easy to fingerprint.
+	padding := 0
+	if strings.HasSuffix(addr.String(), ":53") && len(b) < ss2022MaxPadding {
+		padding = 1 + mrand.IntN(ss2022MaxPadding-len(b))
+	}
+	body := []byte{ss2022ClientType}
+	body = binary.BigEndian.AppendUint64(body, ss2022Timestamp())
+	body = binary.BigEndian.AppendUint16(body, uint16(padding))
+	body = append(body, make([]byte, padding)...)
+	body = append(body, tgt...)
+	body = append(body, b...)
+
+	var pkt []byte
+	if aead := c.cipher.udpAEAD; aead != nil {
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+		pkt = aead.Seal(nonce, nonce, append(header, body...), nil)
+	} else {
+		pkt = make([]byte, aes.BlockSize, 1024)
+		c.cipher.udpEncrypt.Encrypt(pkt, header)
+		for i, psk := range c.cipher.psks[:len(c.cipher.psks)-1] {
+			block, err := aes.NewCipher(psk)
+			if err != nil {
+				return 0, err
+			}
+			identity := make([]byte, aes.BlockSize)
+			for j, h := range c.cipher.pskHash(i) {
+				identity[j] = h ^ header[j]
+			}
+			block.Encrypt(identity, identity)
+			pkt = append(pkt, identity...)
+		}
+		pkt = c.aead.Seal(pkt, header[4:16], body, nil)
+	}
+	if _, err := c.PacketConn.WriteTo(pkt, c.server); err != nil {
+		return 0, fmt.Errorf("failed to write payload to SS UDP: %w", err)
+	}
+	return len(b), nil
+}
+
+func (c *ss2022PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := udpBufPool.Get().(*[udpBufSize]byte)
+	defer udpBufPool.Put(buf)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		payload, addr, err := c.open(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// open decrypts and checks a reply from the server, returning its payload
+// and source address.
+func (c *ss2022PacketConn) open(pkt []byte) ([]byte, net.Addr, error) {
+	var header, body []byte
+	var aead cipher.AEAD
+	if c.cipher.udpAEAD != nil {
+		size := c.cipher.udpAEAD.NonceSize()
+		if len(pkt) < size+16 {
+			return nil, nil, fmt.Errorf("packet too short")
+		}
+		plain, err := c.cipher.udpAEAD.Open(nil, pkt[:size], pkt[size:], nil)
+		if err != nil || len(plain) < 16 {
+			return nil, nil, fmt.Errorf("failed to decrypt packet")
+		}
+		header, body = plain[:16], plain[16:]
+	} else {
+		if len(pkt) < aes.BlockSize {
+			return nil, nil, fmt.Errorf("packet too short")
+		}
+		header = make([]byte, aes.BlockSize)
+		c.cipher.udpDecrypt.Decrypt(header, pkt[:aes.BlockSize])
+		body = pkt[aes.BlockSize:]
+	}
+	sessionID := binary.BigEndian.Uint64(header)
+	packetID := binary.BigEndian.Uint64(header[8:])
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var session *ss2022RemoteSession
+	switch sessionID {
+	case c.remote.id:
+		session = &c.remote
+	case c.previous.id:
+		session = &c.previous
+	default:
+		session = &ss2022RemoteSession{id: sessionID, fresh: true}
+	}
+	if session.window.seen(packetID) {
+		return nil, nil, fmt.Errorf("replayed packet")
+	}
+	if c.cipher.udpAEAD == nil {
+		aead = session.aead
+		if aead == nil {
+			var err error
+			if aead, err = c.cipher.sessionAEAD(header[:8]); err != nil {
+				return nil, nil, err
+			}
+		}
+		var err error
+		if body, err = aead.Open(nil, header[4:16], body, nil); err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt packet")
+		}
+	}
+
+	// type, timestamp, client session ID and padding length
+	if len(body) < 1+8+8+2 || body[0] != ss2022ServerType {
+		return nil, nil, fmt.Errorf("invalid packet header")
+	}
+	if err := checkTimestamp(binary.BigEndian.Uint64(body[1:])); err != nil {
+		return nil, nil, err
+	}
+	if binary.BigEndian.Uint64(body[9:]) != c.sessionID {
+		return nil, nil, fmt.Errorf("packet for another session")
+	}
+	padding := int(binary.BigEndian.Uint16(body[17:]))
+	if len(body) < 19+padding {
+		return nil, nil, fmt.Errorf("invalid packet header")
+	}
+	payload, addr, err := splitPacketAddr(body[19+padding:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if session.fresh {
+		// The server started a new session; keep the old one for packets
+		// still in flight.
+		session.aead, session.fresh = aead, false
+		c.previous, c.remote = c.remote, *session
+		session = &c.remote
+	}
+	session.window.add(packetID)
+	return payload, addr, nil
+}
+
+// replayWindow tracks the packet IDs received recently, as in WireGuard:
+// IDs older than the window, or seen before within it, are replays.
+type replayWindow struct {
+	last uint64
+	bits [replayWindowSize / 64]uint64
+}
+
+const replayWindowSize = 2048
+
+func (w *replayWindow) seen(id uint64) bool {
+	if id > w.last {
+		return false
+	}
+	if w.last-id >= replayWindowSize {
+		return true
+	}
+	i := id % replayWindowSize
+	return w.bits[i/64]&(1<<(i%64)) != 0
+}
+
+func (w *replayWindow) add(id uint64) {
+	if id > w.last {
+		if id-w.last >= replayWindowSize {
+			w.bits = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := w.last + 1; i < id; i++ {
+				j := i % replayWindowSize
+				w.bits[j/64] &^= 1 << (j % 64)
+			}
+		}
+		w.last = id
+	}
+	i := id % replayWindowSize
+	w.bits[i/64] |= 1 << (i % 64)
+}
@@ -0,0 +1,222 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func init() {
+	RegisterOutbound("socks5", func(server config.ServerConfig) (Dialer, error) {
+		return NewSocks5Outbound(server)
+	})
+}
+
+const (
+	socks5Version      = 0x05
+	socks5CmdConnect   = 0x01
+	socks5CmdAssociate = 0x03
+	socks5UserPass     = 0x02 // username/password authentication (RFC 1929)
+	socks5AuthVersion  = 0x01
+)
+
+type Socks5Outbound struct {
+	Server config.ServerConfig
+	dialer Dialer
+}
+
+func NewSocks5Outbound(server config.ServerConfig) (*Socks5Outbound, error) {
+	if len(server.Username) > 255 || len(server.Password) > 255 {
+		return nil, fmt.Errorf("SOCKS5 username and password must be at most 255 bytes")
+	}
+	return &Socks5Outbound{Server: server, dialer: Direct}, nil
+}
+
+func (s *Socks5Outbound) setDialer(d Dialer) error {
+	s.dialer = d
+	return nil
+}
+
+func (s *Socks5Outbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !isTCP(network) {
+		return nil, fmt.Errorf("unsupported network for SOCKS5: %s", network)
+	}
+	tgt := socks.ParseAddr(addr)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid target address: %s", addr)
+	}
+
+	conn, err := s.dialer.DialContext(ctx, "tcp", serverAddr(s.Server))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial SOCKS5 server: %w", err)
+	}
+	clearDeadline := handshakeDeadline(ctx, conn)
+	if _, err := s.handshake(conn, socks5CmdConnect, tgt); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to dial via SOCKS5: %w", err)
+	}
+	clearDeadline()
+	return conn, nil
+}
+
+// ListenPacket opens a SOCKS5 UDP association. The association lives as long
+// as the TCP control connection, which is closed together with the returned
+// packet conn.
+func (s *Socks5Outbound) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	ctrl, err := s.dialer.DialContext(ctx, "tcp", serverAddr(s.Server))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial SOCKS5 server for UDP associate: %w", err)
+	}
+
+	clearDeadline := handshakeDeadline(ctx, ctrl)
+	bnd, err := s.handshake(ctrl, socks5CmdAssociate, socks.Addr{socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("UDP associate failed: %w", err)
+	}
+	clearDeadline()
+	relayAddr, err := net.ResolveUDPAddr("udp", bnd.String())
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("invalid UDP relay address: %w", err)
+	}
+	if relayAddr.IP.IsUnspecified() {
+		// The relay listens on the same host as the SOCKS5 server.
+		host, _, _ := net.SplitHostPort(ctrl.RemoteAddr().String())
+		relayAddr.IP = net.ParseIP(host)
+	}
+
+	pc, err := s.dialer.ListenPacket(ctx, relayAddr.String())
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	go func() {
+		// The server drops the association when the control connection
+		// closes, so stop relaying as soon as that happens.
+		io.Copy(io.Discard, ctrl)
+		pc.Close()
+	}()
+	return &socks5PacketConn{PacketConn: pc, ctrl: ctrl, relay: relayAddr}, nil
+}
+
+// handshake performs the SOCKS5 greeting and authentication and sends cmd
+// for addr, returning the bound address from the server's reply.
+func (s *Socks5Outbound) handshake(conn net.Conn, cmd byte, addr socks.Addr) (socks.Addr, error) {
+	// 1. Greeting, offering username/password authentication if we have
+	// credentials
+	greeting := []byte{socks5Version, 0x01, socks5NoAuth}
+	if s.Server.Username != "" {
+		greeting = []byte{socks5Version, 0x02, socks5NoAuth, socks5UserPass}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, fmt.Errorf("failed to write greeting: %w", err)
+	}
+	resp := make([]byte, 3)
+	if _, err := io.ReadFull(conn, resp[:2]); err != nil {
+		return nil, fmt.Errorf("failed to read greeting reply: %w", err)
+	}
+	if resp[0] != socks5Version || !bytes.Contains(greeting[2:], resp[1:2]) {
+		return nil, fmt.Errorf("server rejected authentication method: %v", resp[:2])
+	}
+	if resp[1] == socks5UserPass {
+		if err := s.authenticate(conn); err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. Send the command
+	req := make([]byte, 0, 3+len(addr))
+	req = append(req, socks5Version, cmd, 0x00)
+	req = append(req, addr...)
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to write request: %w", err)
+	}
+
+	// 3. Read the server's reply
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("failed to read reply: %w", err)
+	}
+	if resp[0] != socks5Version || resp[1] != 0x00 {
+		return nil, fmt.Errorf("server replied with error code %d", resp[1])
+	}
+	bnd, err := socks.ReadAddr(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bound address: %w", err)
+	}
+	return bnd, nil
+}
+
+// authenticate sends the username and password as in RFC 1929.
+func (s *Socks5Outbound) authenticate(conn net.Conn) error {
+	user, pass := s.Server.Username, s.Server.Password
+	req := make([]byte, 0, 3+len(user)+len(pass))
+	req = append(req, socks5AuthVersion, byte(len(user)))
+	req = append(req, user...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("failed to write credentials: %w", err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return fmt.Errorf("failed to read authentication reply: %w", err)
+	}
+	if resp[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 authentication failed")
+	}
+	return nil
+}
+
+// socks5PacketConn wraps datagrams in the SOCKS5 UDP request header and
+// sends them to the association's relay address.
+type socks5PacketConn struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, fmt.Errorf("invalid target address: %s", addr)
+	}
+	pkt := make([]byte, 0, 3+len(tgt)+len(b))
+	pkt = append(pkt, 0x00, 0x00, 0x00) // RSV, FRAG
+	pkt = append(pkt, tgt...)
+	pkt = append(pkt, b...)
+	if _, err := c.PacketConn.WriteTo(pkt, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := udpBufPool.Get().(*[udpBufSize]byte)
+	defer udpBufPool.Put(buf)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf[:])
+		if err != nil {
+			return 0, nil, err
+		}
+		// Drop fragmented and malformed datagrams.
+		if n < 3 || buf[2] != 0x00 {
+			continue
+		}
+		payload, addr, err := splitPacketAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.ctrl.Close()
+	return c.PacketConn.Close()
+}
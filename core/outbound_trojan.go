@@ -0,0 +1,157 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	trojanCmdConnect   = 0x01
+	trojanCmdAssociate = 0x03
+)
+
+var crlf = []byte{'\r', '\n'}
+
+func init() {
+	RegisterOutbound("trojan", func(server config.ServerConfig) (Dialer, error) {
+		return NewTrojanOutbound(server)
+	})
+}
+
+// TrojanOutbound connects through a Trojan server. Trojan runs over TLS
+// unless the server explicitly sets another security.
+type TrojanOutbound struct {
+	Server config.ServerConfig
+	key    []byte // hex SHA-224 of the password
+	dialer Dialer
+	h2     h2Pool
+}
+
+func NewTrojanOutbound(server config.ServerConfig) (*TrojanOutbound, error) {
+	if server.Password == "" {
+		return nil, fmt.Errorf("trojan server requires a password")
+	}
+	if server.Security == "" {
+		server.Security = "tls"
+	}
+	if err := checkTransport(server); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum224([]byte(server.Password))
+	key := make([]byte, hex.EncodedLen(len(sum)))
+	hex.Encode(key, sum[:])
+	return &TrojanOutbound{Server: server, key: key, dialer: Direct}, nil
+}
+
+func (t *TrojanOutbound) setDialer(d Dialer) error {
+	t.dialer = d
+	return nil
+}
+
+// Close closes the HTTP/2 connection of the gRPC and HTTP/2 transports.
+func (t *TrojanOutbound) Close() error {
+	return t.h2.Close()
+}
+
+func (t *TrojanOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !isTCP(network) {
+		return nil, fmt.Errorf("unsupported network for Trojan: %s", network)
+	}
+	return t.dial(ctx, trojanCmdConnect, addr)
+}
+
+// ListenPacket opens a UDP ASSOCIATE session. Every datagram carries its own
+// destination, so the session is not bound to addr.
+func (t *TrojanOutbound) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	conn, err := t.dial(ctx, trojanCmdAssociate, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &trojanPacketConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (t *TrojanOutbound) dial(ctx context.Context, cmd byte, addr string) (net.Conn, error) {
+	tgt := socks.ParseAddr(addr)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid target address: %s", addr)
+	}
+	conn, err := dialTransport(ctx, t.dialer, t.Server, &t.h2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Trojan server: %w", err)
+	}
+
+	req := make([]byte, 0, len(t.key)+len(tgt)+5)
+	req = append(req, t.key...)
+	req = append(req, crlf...)
+	req = append(req, cmd)
+	req = append(req, tgt...)
+	req = append(req, crlf...)
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send Trojan request: %w", err)
+	}
+	return conn, nil
+}
+
+// trojanPacketConn frames each datagram as its address, 16-bit length and
+// CRLF, followed by the payload.
+type trojanPacketConn struct {
+	net.Conn
+	r   *bufio.Reader
+	rmu sync.Mutex
+	wmu sync.Mutex
+}
+
+func (c *trojanPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	tgt := socks.ParseAddr(addr.String())
+	if tgt == nil {
+		return 0, fmt.Errorf("invalid target address: %s", addr)
+	}
+	if len(b) > 0xFFFF {
+		return 0, fmt.Errorf("datagram too large: %d bytes", len(b))
+	}
+	pkt := make([]byte, 0, len(tgt)+4+len(b))
+	pkt = append(pkt, tgt...)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(len(b)))
+	pkt = append(pkt, crlf...)
+	pkt = append(pkt, b...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.Conn.Write(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *trojanPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	src, err := socks.ReadAddr(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:2]))
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", src.String())
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, payload), addr, nil
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	vlessVersion = 0x00
+
+	vlessCmdTCP = 0x01
+	vlessCmdUDP = 0x02
+
+	vlessAtypIPv4   = 0x01
+	vlessAtypDomain = 0x02
+	vlessAtypIPv6   = 0x03
+)
+
+func init() {
+	RegisterOutbound("vless", func(server config.ServerConfig) (Dialer, error) {
+		return NewVlessOutbound(server)
+	})
+}
+
+// VlessOutbound connects through a VLESS server.
+type VlessOutbound struct {
+	Server config.ServerConfig
+	id     [16]byte
+	vision bool // TCP streams use the Vision flow
+	dialer Dialer
+	h2     h2Pool
+}
+
+func NewVlessOutbound(server config.ServerConfig) (*VlessOutbound, error) {
+	id, err := parseUUID(server.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransport(server); err != nil {
+		return nil, err
+	}
+	v := &VlessOutbound{Server: server, id: id, dialer: Direct}
+	switch server.Flow {
+	case "", "none":
+	case vlessFlowVision:
+		// Vision looks at the TLS records inside the stream, which only a
+		// TLS connection of its own carries.
+		if security, _ := serverSecurity(server); security != "tls" || (server.Network != "" && server.Network != "tcp") {
+			return nil, fmt.Errorf("VLESS flow %s needs TLS over the tcp transport", server.Flow)
+		}
+		v.vision = true
+	default:
+		return nil, fmt.Errorf("unsupported VLESS flow: %s", server.Flow)
+	}
+	return v, nil
+}
+
+func (v *VlessOutbound) setDialer(d Dialer) error {
+	v.dialer = d
+	return nil
+}
+
+// Close closes the HTTP/2 connection of the gRPC and HTTP/2 transports.
+func (v *VlessOutbound) Close() error {
+	return v.h2.Close()
+}
+
+func (v *VlessOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !isTCP(network) {
+		return nil, fmt.Errorf("unsupported network for VLESS: %s", network)
+	}
+	return v.dial(ctx, vlessCmdTCP, addr)
+}
+
+func (v *VlessOutbound) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	conn, err := v.dial(ctx, vlessCmdUDP, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &vlessPacketConn{Conn: conn, target: addr}, nil
+}
+
+// dial opens a stream to the server and sends the VLESS request header for
+// addr. The response header is read along with the first reply bytes.
+func (v *VlessOutbound) dial(ctx context.Context, cmd byte, addr string) (net.Conn, error) {
+	// Servers with the Vision flow take UDP sessions without it.
+	flow := ""
+	if v.vision && cmd == vlessCmdTCP {
+		flow = vlessFlowVision
+	}
+	header, err := v.requestHeader(cmd, flow, addr)
+	if err != nil {
+		return nil, err
+	}
+	if flow != "" {
+		return v.dialVision(ctx, header)
+	}
+	conn, err := dialTransport(ctx, v.dialer, v.Server, &v.h2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to VLESS server: %w", err)
+	}
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send VLESS request: %w", err)
+	}
+	return &vlessConn{Conn: conn}, nil
+}
+
+// dialVision opens a TLS stream to the server and sends header, the request
+// of a TCP stream with the Vision flow.
+func (v *VlessOutbound) dialVision(ctx context.Context, header []byte) (net.Conn, error) {
+	conn, raw, err := dialVisionTLS(ctx, v.dialer, v.Server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to VLESS server: %w", err)
+	}
+	c, err := newVisionConn(&vlessConn{Conn: conn}, raw, v.id, header)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send VLESS request: %w", err)
+	}
+	return c, nil
+}
+
+// requestHeader returns the request header for cmd to addr. A flow is sent
+// in the addons, a protobuf message whose field 1 is the flow.
+func (v *VlessOutbound) requestHeader(cmd byte, flow, addr string) ([]byte, error) {
+	tgt := socks.ParseAddr(addr)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid target address: %s", addr)
+	}
+	header := make([]byte, 0, 24+len(flow)+len(tgt))
+	header = append(header, vlessVersion)
+	header = append(header, v.id[:]...)
+	if flow == "" {
+		header = append(header, 0) // no addons
+	} else {
+		header = append(header, byte(2+len(flow)), 0x0A, byte(len(flow)))
+		header = append(header, flow...)
+	}
+	header = append(header, cmd)
+	return appendPortAddr(header, tgt), nil
+}
+
+// appendPortAddr appends tgt in the form used by VLESS and VMess requests,
+// which put the port before the address and number the address types
+// differently from SOCKS.
+func appendPortAddr(b []byte, tgt socks.Addr) []byte {
+	b = append(b, tgt[len(tgt)-2:]...)
+	switch tgt[0] {
+	case socks.AtypIPv4:
+		b = append(b, vlessAtypIPv4)
+	case socks.AtypDomainName:
+		b = append(b, vlessAtypDomain)
+	case socks.AtypIPv6:
+		b = append(b, vlessAtypIPv6)
+	}
+	return append(b, tgt[1:len(tgt)-2]...)
+}
+
+// vlessConn strips the VLESS response header from the start of the stream.
+type vlessConn struct {
+	net.Conn
+	once sync.Once
+	err  error
+}
+
+func (c *vlessConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		hdr := make([]byte, 2)
+		if _, c.err = io.ReadFull(c.Conn, hdr); c.err != nil {
+			return
+		}
+		if hdr[0] != vlessVersion {
+			c.err = fmt.Errorf("unexpected VLESS response version %d", hdr[0])
+			return
+		}
+		_, c.err = io.CopyN(io.Discard, c.Conn, int64(hdr[1]))
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// CloseWrite half-closes the underlying stream if it supports it.
+func (c *vlessConn) CloseWrite() error {
+	return forwardCloseWrite(c.Conn)
+}
+
+// vlessPacketConn carries the datagrams of a VLESS UDP session, each
+// prefixed with its 16-bit length. The session is bound to its target.
+type vlessPacketConn struct {
+	net.Conn
+	target string
+	rmu    sync.Mutex
+	wmu    sync.Mutex
+}
+
+func (c *vlessPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > 0xFFFF {
+		return 0, fmt.Errorf("datagram too large: %d bytes", len(b))
+	}
+	pkt := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(pkt, uint16(len(b)))
+	copy(pkt[2:], b)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.Conn.Write(pkt); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *vlessPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var size [2]byte
+	if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > len(b) {
+		if _, err := io.ReadFull(c.Conn, b); err != nil {
+			return 0, nil, err
+		}
+		_, err := io.CopyN(io.Discard, c.Conn, int64(n-len(b)))
+		return len(b), packetAddr(c.target), err
+	}
+	if _, err := io.ReadFull(c.Conn, b[:n]); err != nil {
+		return 0, nil, err
+	}
+	return n, packetAddr(c.target), nil
+}
+
+// parseUUID parses a user ID in the standard UUID form. Other strings of up
+// to 30 bytes are mapped to a UUID as Xray does: the UUIDv5 of the string
+// in the all-zero namespace.
+func parseUUID(s string) ([16]byte, error) {
+	var id [16]byte
+	if b, err := hex.DecodeString(strings.ReplaceAll(s, "-", "")); err == nil && len(b) == 16 && len(s) == 36 {
+		copy(id[:], b)
+		return id, nil
+	}
+	if len(s) == 0 || len(s) > 30 {
+		return id, fmt.Errorf("invalid user ID: %q", s)
+	}
+	h := sha1.New()
+	h.Write(id[:])
+	h.Write([]byte(s))
+	copy(id[:], h.Sum(nil))
+	id[6] = id[6]&0x0F | 0x50
+	id[8] = id[8]&0x3F | 0x80
+	return id, nil
+}
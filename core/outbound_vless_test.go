@@ -0,0 +1,266 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+const testVlessUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+// vlessStandIn accepts one connection on ln, checks its VLESS request header
+// for a TCP stream to want, answers with a response header carrying an
+// addon, and echoes the stream back.
+func vlessStandIn(t *testing.T, ln net.Listener, want []byte) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		hdr := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			errc <- err
+			return
+		}
+		if !bytes.Equal(hdr, want) {
+			t.Errorf("request header = %x, want %x", hdr, want)
+		}
+		if _, err := conn.Write([]byte{vlessVersion, 2, 0xaa, 0xbb}); err != nil {
+			errc <- err
+			return
+		}
+		_, err = io.Copy(conn, conn)
+		errc <- err
+	}()
+	return errc
+}
+
+func TestVlessRoundTrip(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	id, err := parseUUID(testVlessUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{vlessVersion}
+	want = append(want, id[:]...)
+	want = append(want, 0, vlessCmdTCP)
+	want = binary.BigEndian.AppendUint16(want, 443)
+	want = append(want, vlessAtypDomain, byte(len("example.com")))
+	want = append(want, "example.com"...)
+	errc := vlessStandIn(t, ln, want)
+
+	v, err := NewVlessOutbound(config.ServerConfig{
+		Type:    "vless",
+		Address: "127.0.0.1",
+		Port:    port,
+		UUID:    testVlessUUID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := v.DialContext(context.Background(), "tcp", net.JoinHostPort("example.com", strconv.Itoa(443)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := []byte("hello through VLESS")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("echo = %q, want %q", got, msg)
+	}
+	if err := conn.(closeWriter).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVlessRejectsFlow(t *testing.T) {
+	for _, server := range []config.ServerConfig{
+		{Flow: "xtls-rprx-direct", TLS: true},
+		{Flow: vlessFlowVision},
+		{Flow: vlessFlowVision, TLS: true, Network: "ws"},
+	} {
+		server.Type = "vless"
+		server.Address = "127.0.0.1"
+		server.Port = 443
+		server.UUID = testVlessUUID
+		if _, err := NewVlessOutbound(server); err == nil {
+			t.Errorf("flow %s accepted with network %q and TLS %v", server.Flow, server.Network, server.TLS)
+		}
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// readVisionFrame reads a padded Vision frame from r and returns its
+// command and content.
+func readVisionFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(hdr[1:]))
+	frame := make([]byte, size+int(binary.BigEndian.Uint16(hdr[3:])))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], frame[:size], nil
+}
+
+// appendVisionFrame appends a Vision frame with a few bytes of padding.
+func appendVisionFrame(b []byte, command byte, content string) []byte {
+	b = append(b, command)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(content)))
+	b = binary.BigEndian.AppendUint16(b, 3)
+	b = append(b, content...)
+	return append(b, 0, 0, 0)
+}
+
+// visionStandIn accepts one TLS connection on ln and checks its VLESS
+// request header, want, and the padded request "hello". It answers in
+// padded frames, switches to direct copy midway and writes the rest of its
+// answer on the raw connection.
+func visionStandIn(ln net.Listener, cert tls.Certificate, id [16]byte, want []byte) error {
+	raw, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	conn := tls.Server(raw, &tls.Config{Certificates: []tls.Certificate{cert}})
+	hdr := make([]byte, len(want)+16)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:len(want)], want) || !bytes.Equal(hdr[len(want):], id[:]) {
+		return fmt.Errorf("request = %x, want header %x and the user ID", hdr, want)
+	}
+	// The empty frame sent with the header, then the request.
+	for _, expect := range []string{"", "hello"} {
+		command, content, err := readVisionFrame(conn)
+		if err != nil {
+			return err
+		}
+		if command != visionContinue || string(content) != expect {
+			return fmt.Errorf("got frame %d %q, want %d %q", command, content, visionContinue, expect)
+		}
+	}
+
+	resp := []byte{vlessVersion, 0}
+	resp = append(resp, id[:]...)
+	resp = appendVisionFrame(resp, visionContinue, "hel")
+	resp = appendVisionFrame(resp, visionDirect, "lo")
+	if _, err := conn.Write(resp); err != nil {
+		return err
+	}
+	if _, err := raw.Write([]byte(" raw")); err != nil {
+		return err
+	}
+	// Wait for the client to finish.
+	_, err = io.Copy(io.Discard, raw)
+	return err
+}
+
+// TestVlessVision runs a TCP stream with the Vision flow against a stand-in
+// server that switches to direct copy.
+func TestVlessVision(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	id, err := parseUUID(testVlessUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{vlessVersion}
+	want = append(want, id[:]...)
+	want = append(want, byte(2+len(vlessFlowVision)), 0x0A, byte(len(vlessFlowVision)))
+	want = append(want, vlessFlowVision...)
+	want = append(want, vlessCmdTCP)
+	want = binary.BigEndian.AppendUint16(want, 443)
+	want = append(want, vlessAtypIPv4, 192, 0, 2, 1)
+	cert := testCertificate(t)
+	errc := make(chan error, 1)
+	go func() { errc <- visionStandIn(ln, cert, id, want) }()
+
+	v, err := NewVlessOutbound(config.ServerConfig{
+		Type:          "vless",
+		Address:       "127.0.0.1",
+		Port:          ln.Addr().(*net.TCPAddr).Port,
+		UUID:          testVlessUUID,
+		Flow:          vlessFlowVision,
+		TLS:           true,
+		AllowInsecure: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := v.DialContext(context.Background(), "tcp", "192.0.2.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len("hello raw"))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello raw" {
+		t.Errorf("answer = %q, want %q", got, "hello raw")
+	}
+	conn.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,301 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+// vlessFlowVision is the XTLS Vision flow. It pads the first packets of a
+// TCP stream to hide the length pattern of TLS inside TLS. Once the TLS
+// handshake inside has finished, the server may stop using the outer TLS
+// and send the inner records over the raw TCP connection ("direct copy").
+// NekoGo reads such streams but always writes through the outer TLS, which
+// servers accept.
+const vlessFlowVision = "xtls-rprx-vision"
+
+// The commands of Vision frames.
+const (
+	visionContinue = 0x00 // more padded frames follow
+	visionEnd      = 0x01 // the stream continues unpadded
+	visionDirect   = 0x02 // the stream continues unpadded on the raw connection
+)
+
+const (
+	// visionMaxContent is the most content a frame carries, so that frames
+	// with their padding fit Xray's 8 KiB buffers.
+	visionMaxContent = 8192 - 21
+
+	// visionFilterPackets is the number of packets watched for the TLS
+	// handshake inside the stream.
+	visionFilterPackets = 8
+)
+
+// The starts of TLS records that Vision looks for.
+var (
+	tlsClientHandshake = []byte{0x16, 0x03}
+	tlsServerHandshake = []byte{0x16, 0x03, 0x03}
+	tlsApplicationData = []byte{0x17, 0x03, 0x03}
+)
+
+const (
+	tlsClientHello = 0x01
+	tlsServerHello = 0x02
+)
+
+// The states of the read side of a visionConn.
+const (
+	visionReadStart  = iota // before the first frame, which starts with the user ID
+	visionReadPadded        // within padded frames
+	visionReadPlain         // unpadded, through the outer TLS
+	visionReadDirect        // unpadded, on the raw connection
+)
+
+// dialVisionTLS connects to server over TLS for the Vision flow. The raw
+// connection is returned too, for reading once the server switches to it.
+func dialVisionTLS(ctx context.Context, dialer Dialer, server config.ServerConfig) (*tls.Conn, *recordConn, error) {
+	cfg, err := tlsConfig(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddr(server))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial server: %w", err)
+	}
+	raw := newRecordConn(conn)
+	tlsConn := tls.Client(raw, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, raw, nil
+}
+
+// recordConn hands the TLS records it reads to a tls.Conn one at a time, so
+// that the tls.Conn never buffers bytes past the record it is reading and
+// the bytes after the last TLS record can be read raw.
+type recordConn struct {
+	net.Conn
+	r    *bufio.Reader
+	left int // unread bytes of the current record
+}
+
+func newRecordConn(conn net.Conn) *recordConn {
+	return &recordConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	if c.left == 0 {
+		hdr, err := c.r.Peek(5)
+		if err != nil {
+			return 0, err
+		}
+		c.left = 5 + int(binary.BigEndian.Uint16(hdr[3:]))
+	}
+	n, err := c.r.Read(b[:min(len(b), c.left)])
+	c.left -= n
+	return n, err
+}
+
+// readRaw reads the stream after the last TLS record.
+func (c *recordConn) readRaw(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// visionConn pads and unpads the TCP stream of a VLESS connection with the
+// Vision flow.
+type visionConn struct {
+	net.Conn // the VLESS stream over the outer TLS
+	raw      *recordConn
+	id       [16]byte
+
+	mu         sync.Mutex
+	filterLeft int  // packets still to watch for the TLS handshake
+	isTLS      bool // a TLS handshake was seen
+	isTLS12    bool // a TLS 1.2 or later server hello was seen
+
+	wmu     sync.Mutex
+	padding bool // writes are still padded
+	sentID  bool
+
+	rmu     sync.Mutex
+	state   int
+	pending []byte // unpadded bytes read ahead
+	command byte   // command of the current frame
+	content int    // unread content of the current frame
+	skip    int    // unread padding of the current frame
+}
+
+// newVisionConn returns a visionConn over conn, a VLESS stream whose request
+// header has not been written yet. It writes header followed by a padded
+// empty frame, which hides the length of the header.
+func newVisionConn(conn net.Conn, raw *recordConn, id [16]byte, header []byte) (*visionConn, error) {
+	c := &visionConn{Conn: conn, raw: raw, id: id, filterLeft: visionFilterPackets, padding: true}
+	if _, err := conn.Write(c.appendFrame(header, visionContinue, nil, true)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// filter watches b, a packet of the stream in either direction, for the TLS
+// handshake inside the stream. It returns what it has learned and how many
+// packets are still to be watched.
+func (c *visionConn) filter(b []byte) (isTLS, isTLS12 bool, left int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.filterLeft > 0 {
+		c.filterLeft--
+		if len(b) >= 6 {
+			switch {
+			case bytes.HasPrefix(b, tlsServerHandshake) && b[5] == tlsServerHello:
+				c.isTLS, c.isTLS12 = true, true
+			case bytes.HasPrefix(b, tlsClientHandshake) && b[5] == tlsClientHello:
+				c.isTLS = true
+			}
+		}
+	}
+	return c.isTLS, c.isTLS12, c.filterLeft
+}
+
+// appendFrame appends a frame carrying content to b. The first frame is
+// prefixed with the user ID. Long padding brings short frames to 900 bytes
+// or more.
+func (c *visionConn) appendFrame(b []byte, command byte, content []byte, long bool) []byte {
+	var padding int
+	if long && len(content) < 900 {
+		padding = rand.IntN(500) + 900 - len(content)
+	} else {
+		padding = rand.IntN(256)
+	}
+	padding = min(padding, visionMaxContent-len(content))
+	if !c.sentID {
+		b = append(b, c.id[:]...)
+		c.sentID = true
+	}
+	b = append(b, command)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(content)))
+	b = binary.BigEndian.AppendUint16(b, uint16(padding))
+	b = append(b, content...)
+	return append(b, make([]byte, padding)...)
+}
+
+// Write pads b until the TLS handshake inside the stream is over: until
+// the first application data record of TLS 1.2 or later, or after the
+// first few packets of other traffic.
+func (c *visionConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if !c.padding || len(b) == 0 {
+		return c.Conn.Write(b)
+	}
+	isTLS, isTLS12, left := c.filter(b)
+	out := make([]byte, 0, len(b)+1024)
+	rest := b
+	for len(rest) > 0 {
+		chunk := rest[:min(len(rest), visionMaxContent)]
+		rest = rest[len(chunk):]
+		long := isTLS
+		if isTLS && bytes.HasPrefix(chunk, tlsApplicationData) {
+			c.padding = false
+			long = true
+		} else if c.padding && !isTLS12 && left <= 1 {
+			c.padding = false
+			out = c.appendFrame(out, visionEnd, chunk, long)
+			out = append(out, rest...)
+			break
+		}
+		command := byte(visionContinue)
+		if !c.padding && len(rest) == 0 {
+			command = visionEnd
+		}
+		out = c.appendFrame(out, command, chunk, long)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read unpads the stream, switching to the raw connection when the server
+// does.
+func (c *visionConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		if len(c.pending) > 0 {
+			n := copy(b, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+		switch c.state {
+		case visionReadDirect:
+			return c.raw.readRaw(b)
+		case visionReadPlain:
+			n, err := c.Conn.Read(b)
+			c.filter(b[:n])
+			return n, err
+		case visionReadStart:
+			first := make([]byte, 16+5)
+			n, err := io.ReadFull(c.Conn, first)
+			if err != nil || !bytes.Equal(first[:16], c.id[:]) {
+				// The server does not pad.
+				c.state = visionReadPlain
+				c.pending = first[:n]
+				if n == 0 {
+					return 0, err
+				}
+				continue
+			}
+			c.startFrame(first[16:])
+			c.state = visionReadPadded
+		case visionReadPadded:
+			if c.content > 0 {
+				n, err := c.Conn.Read(b[:min(len(b), c.content)])
+				c.content -= n
+				c.filter(b[:n])
+				return n, err
+			}
+			if c.skip > 0 {
+				if _, err := io.CopyN(io.Discard, c.Conn, int64(c.skip)); err != nil {
+					return 0, err
+				}
+				c.skip = 0
+			}
+			switch c.command {
+			case visionContinue:
+				var hdr [5]byte
+				if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+					return 0, err
+				}
+				c.startFrame(hdr[:])
+			case visionEnd:
+				c.state = visionReadPlain
+			case visionDirect:
+				c.state = visionReadDirect
+			default:
+				return 0, fmt.Errorf("unknown Vision command %d", c.command)
+			}
+		}
+	}
+}
+
+// startFrame starts reading the frame with the 5-byte header hdr.
+func (c *visionConn) startFrame(hdr []byte) {
+	c.command = hdr[0]
+	c.content = int(binary.BigEndian.Uint16(hdr[1:]))
+	c.skip = int(binary.BigEndian.Uint16(hdr[3:]))
+}
+
+// CloseWrite half-closes the outer TLS stream.
+func (c *visionConn) CloseWrite() error {
+	return forwardCloseWrite(c.Conn)
+}
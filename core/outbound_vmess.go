@@ -0,0 +1,432 @@
+package core
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha3"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	vmessVersion = 0x01
+
+	vmessCmdTCP = 0x01
+	vmessCmdUDP = 0x02
+
+	vmessOptChunkStream  = 0x01
+	vmessOptChunkMasking = 0x04
+
+	vmessSecurityAES128GCM        = 0x03
+	vmessSecurityChacha20Poly1305 = 0x04
+	vmessSecurityNone             = 0x05
+
+	// vmessMaxChunk is the largest payload written in a single chunk.
+	vmessMaxChunk = 16 * 1024
+)
+
+func init() {
+	RegisterOutbound("vmess", func(server config.ServerConfig) (Dialer, error) {
+		return NewVmessOutbound(server)
+	})
+}
+
+// VmessOutbound connects through a VMess server using AEAD header
+// encryption. The legacy MD5 header authentication used with a non-zero
+// alterId is not supported, so AlterID is ignored.
+type VmessOutbound struct {
+	Server   config.ServerConfig
+	cmdKey   [16]byte
+	security byte
+	dialer   Dialer
+	h2       h2Pool
+}
+
+// NewVmessOutbound creates a VMess outbound. The body security is taken from
+// server.Method: "aes-128-gcm", "chacha20-poly1305", "none", or "auto"
+// (the default), which picks AES-GCM where the CPU accelerates it.
+func NewVmessOutbound(server config.ServerConfig) (*VmessOutbound, error) {
+	id, err := parseUUID(server.UUID)
+	if err != nil {
+		return nil, err
+	}
+	var security byte
+	switch server.Method {
+	case "", "auto":
+		security = vmessSecurityChacha20Poly1305
+		switch runtime.GOARCH {
+		case "amd64", "arm64", "s390x":
+			security = vmessSecurityAES128GCM
+		}
+	case "aes-128-gcm":
+		security = vmessSecurityAES128GCM
+	case "chacha20-poly1305":
+		security = vmessSecurityChacha20Poly1305
+	case "none":
+		security = vmessSecurityNone
+	default:
+		return nil, fmt.Errorf("unsupported VMess security: %s", server.Method)
+	}
+	if err := checkTransport(server); err != nil {
+		return nil, err
+	}
+
+	v := &VmessOutbound{Server: server, security: security, dialer: Direct}
+	h := md5.New()
+	h.Write(id[:])
+	h.Write([]byte("c48619fe-8f02-49e0-b9e9-edf763e17e21"))
+	copy(v.cmdKey[:], h.Sum(nil))
+	return v, nil
+}
+
+func (v *VmessOutbound) setDialer(d Dialer) error {
+	v.dialer = d
+	return nil
+}
+
+// Close closes the HTTP/2 connection of the gRPC and HTTP/2 transports.
+func (v *VmessOutbound) Close() error {
+	return v.h2.Close()
+}
+
+func (v *VmessOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !isTCP(network) {
+		return nil, fmt.Errorf("unsupported network for VMess: %s", network)
+	}
+	return v.dial(ctx, vmessCmdTCP, addr)
+}
+
+func (v *VmessOutbound) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	conn, err := v.dial(ctx, vmessCmdUDP, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &vmessPacketConn{vmessConn: conn, target: addr}, nil
+}
+
+// dial opens a stream to the server and sends the sealed request header for
+// addr. The response header is read along with the first reply bytes.
+func (v *VmessOutbound) dial(ctx context.Context, cmd byte, addr string) (*vmessConn, error) {
+	tgt := socks.ParseAddr(addr)
+	if tgt == nil {
+		return nil, fmt.Errorf("invalid target address: %s", addr)
+	}
+	c := &vmessConn{}
+	rand.Read(c.reqKey[:])
+	rand.Read(c.reqIV[:])
+	var respV [1]byte
+	rand.Read(respV[:])
+	c.respV = respV[0]
+
+	var err error
+	if c.writer, err = newVmessChunkStream(v.security, c.reqKey[:], c.reqIV[:]); err != nil {
+		return nil, err
+	}
+	respKey := sha256.Sum256(c.reqKey[:])
+	respIV := sha256.Sum256(c.reqIV[:])
+	copy(c.respKey[:], respKey[:16])
+	copy(c.respIV[:], respIV[:16])
+	if c.reader, err = newVmessChunkStream(v.security, c.respKey[:], c.respIV[:]); err != nil {
+		return nil, err
+	}
+
+	header, err := v.sealHeader(v.requestHeader(c, cmd, tgt))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialTransport(ctx, v.dialer, v.Server, &v.h2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to VMess server: %w", err)
+	}
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send VMess request: %w", err)
+	}
+	c.Conn = conn
+	return c, nil
+}
+
+func (v *VmessOutbound) requestHeader(c *vmessConn, cmd byte, tgt socks.Addr) []byte {
+	var padding [1]byte
+	rand.Read(padding[:])
+	paddingLen := int(padding[0] & 0x0F)
+
+	header := make([]byte, 0, 64+len(tgt))
+	header = append(header, vmessVersion)
+	header = append(header, c.reqIV[:]...)
+	header = append(header, c.reqKey[:]...)
+	header = append(header, c.respV)
+	header = append(header, vmessOptChunkStream|vmessOptChunkMasking)
+	header = append(header, byte(paddingLen<<4)|v.security)
+	header = append(header, 0) // reserved
+	header = append(header, cmd)
+	header = appendPortAddr(header, tgt)
+	pad := make([]byte, paddingLen)
+	rand.Read(pad)
+	header = append(header, pad...)
+
+	h := fnv.New32a()
+	h.Write(header)
+	return h.Sum(header)
+}
+
+// sealHeader encrypts a request header in the AEAD format: an encrypted
+// auth ID, then the sealed header length and header.
+func (v *VmessOutbound) sealHeader(header []byte) ([]byte, error) {
+	var authID [16]byte
+	binary.BigEndian.PutUint64(authID[:8], uint64(time.Now().Unix()))
+	rand.Read(authID[8:12])
+	binary.BigEndian.PutUint32(authID[12:], crc32.ChecksumIEEE(authID[:12]))
+	block, err := aes.NewCipher(vmessKDF(v.cmdKey[:], "AES Auth ID Encryption")[:16])
+	if err != nil {
+		return nil, err
+	}
+	block.Encrypt(authID[:], authID[:])
+
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	length := binary.BigEndian.AppendUint16(nil, uint16(len(header)))
+
+	out := append([]byte(nil), authID[:]...)
+	lengthAEAD, err := newAESGCM(vmessKDF(v.cmdKey[:], "VMess Header AEAD Key_Length", string(authID[:]), string(nonce[:]))[:16])
+	if err != nil {
+		return nil, err
+	}
+	out = lengthAEAD.Seal(out, vmessKDF(v.cmdKey[:], "VMess Header AEAD Nonce_Length", string(authID[:]), string(nonce[:]))[:12], length, authID[:])
+	out = append(out, nonce[:]...)
+	headerAEAD, err := newAESGCM(vmessKDF(v.cmdKey[:], "VMess Header AEAD Key", string(authID[:]), string(nonce[:]))[:16])
+	if err != nil {
+		return nil, err
+	}
+	return headerAEAD.Seal(out, vmessKDF(v.cmdKey[:], "VMess Header AEAD Nonce", string(authID[:]), string(nonce[:]))[:12], header, authID[:]), nil
+}
+
+// vmessKDF derives a key from key by nested HMAC-SHA256 over path, as
+// defined for VMess AEAD.
+func vmessKDF(key []byte, path ...string) []byte {
+	newHash := func() hash.Hash { return hmac.New(sha256.New, []byte("VMess AEAD KDF")) }
+	for _, p := range path {
+		parent := newHash
+		newHash = func() hash.Hash { return hmac.New(parent, []byte(p)) }
+	}
+	h := newHash()
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// vmessConn carries a VMess chunk stream in both directions.
+type vmessConn struct {
+	net.Conn
+	reqKey, reqIV   [16]byte
+	respKey, respIV [16]byte
+	respV           byte
+
+	wmu    sync.Mutex
+	writer *vmessChunkStream
+
+	once   sync.Once
+	err    error
+	reader *vmessChunkStream
+	rbuf   []byte
+}
+
+func (c *vmessConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		chunk, err := c.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf = chunk
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// readChunk returns the payload of the next chunk, or io.EOF once the
+// server has ended the stream.
+func (c *vmessConn) readChunk() ([]byte, error) {
+	c.once.Do(func() { c.err = c.readResponseHeader() })
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.reader.open(c.Conn)
+}
+
+func (c *vmessConn) readResponseHeader() error {
+	lengthAEAD, err := newAESGCM(vmessKDF(c.respKey[:], "AEAD Resp Header Len Key")[:16])
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2+lengthAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	length, err := lengthAEAD.Open(nil, vmessKDF(c.respIV[:], "AEAD Resp Header Len IV")[:12], buf, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt VMess response header: %w", err)
+	}
+
+	headerAEAD, err := newAESGCM(vmessKDF(c.respKey[:], "AEAD Resp Header Key")[:16])
+	if err != nil {
+		return err
+	}
+	buf = make([]byte, int(binary.BigEndian.Uint16(length))+headerAEAD.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return err
+	}
+	header, err := headerAEAD.Open(nil, vmessKDF(c.respIV[:], "AEAD Resp Header IV")[:12], buf, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt VMess response header: %w", err)
+	}
+	if len(header) < 4 || header[0] != c.respV {
+		return fmt.Errorf("invalid VMess response header")
+	}
+	return nil
+}
+
+func (c *vmessConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		size := min(len(b), vmessMaxChunk)
+		if _, err := c.Conn.Write(c.writer.seal(nil, b[:size])); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite ends the request stream with an empty chunk.
+func (c *vmessConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(c.writer.seal(nil, nil))
+	return err
+}
+
+// vmessPacketConn carries one datagram per chunk. The session is bound to
+// its target.
+type vmessPacketConn struct {
+	*vmessConn
+	target string
+	rmu    sync.Mutex
+}
+
+func (c *vmessPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > vmessMaxChunk {
+		return 0, fmt.Errorf("datagram too large: %d bytes", len(b))
+	}
+	return c.vmessConn.Write(b)
+}
+
+func (c *vmessPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	chunk, err := c.readChunk()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, chunk), packetAddr(c.target), nil
+}
+
+// vmessChunkStream encodes or decodes one direction of a VMess body: chunks
+// with a masked 16-bit length, sealed with the negotiated AEAD.
+type vmessChunkStream struct {
+	aead  cipher.AEAD // nil for security "none"
+	iv    []byte
+	mask  *sha3.SHAKE
+	count uint16
+}
+
+func newVmessChunkStream(security byte, key, iv []byte) (*vmessChunkStream, error) {
+	s := &vmessChunkStream{iv: iv, mask: sha3.NewSHAKE128()}
+	s.mask.Write(iv)
+	var err error
+	switch security {
+	case vmessSecurityAES128GCM:
+		s.aead, err = newAESGCM(key)
+	case vmessSecurityChacha20Poly1305:
+		k := md5.Sum(key)
+		k2 := md5.Sum(k[:])
+		s.aead, err = chacha20poly1305.New(append(k[:], k2[:]...))
+	}
+	return s, err
+}
+
+func (s *vmessChunkStream) nextMask() uint16 {
+	var b [2]byte
+	s.mask.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func (s *vmessChunkStream) nextNonce() []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.iv)
+	binary.BigEndian.PutUint16(nonce, s.count)
+	s.count++
+	return nonce
+}
+
+// seal appends payload to dst as a chunk.
+func (s *vmessChunkStream) seal(dst, payload []byte) []byte {
+	if s.aead == nil {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(payload))^s.nextMask())
+		return append(dst, payload...)
+	}
+	size := len(payload) + s.aead.Overhead()
+	dst = binary.BigEndian.AppendUint16(dst, uint16(size)^s.nextMask())
+	return s.aead.Seal(dst, s.nextNonce(), payload, nil)
+}
+
+// open reads the next chunk from r and returns its payload, or io.EOF for
+// the empty chunk that ends the stream.
+func (s *vmessChunkStream) open(r io.Reader) ([]byte, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(b[:]) ^ s.nextMask())
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if s.aead != nil {
+		var err error
+		if buf, err = s.aead.Open(buf[:0], s.nextNonce(), buf, nil); err != nil {
+			return nil, fmt.Errorf("failed to decrypt VMess chunk: %w", err)
+		}
+	}
+	if len(buf) == 0 {
+		return nil, io.EOF
+	}
+	return buf, nil
+}
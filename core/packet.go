@@ -0,0 +1,241 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// IPv6 extension headers that may precede the transport header.
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6AuthHeader  = 51
+	ipv6NoNextHdr   = 59
+	ipv6DestOptions = 60
+)
+
+// ipHeader holds the fields of an IPv4 or IPv6 header needed to dispatch a
+// packet read from the TUN device.
+type ipHeader struct {
+	Version int
+	Src     netip.Addr
+	Dst     netip.Addr
+	// Protocol is the transport protocol, after any IPv6 extension headers.
+	Protocol uint8
+	// Offset is where the transport header starts.
+	Offset int
+	// Length is the total packet length announced by the IP header.
+	Length int
+	// Fragment reports whether the packet is part of a fragmented datagram.
+	Fragment bool
+}
+
+// parseIPHeader parses the IP header of pkt, walking the IPv6 extension
+// header chain to find the transport protocol.
+func parseIPHeader(pkt []byte) (*ipHeader, error) {
+	if len(pkt) < 1 {
+		return nil, fmt.Errorf("packet too short")
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < ipv4HeaderLen {
+			return nil, fmt.Errorf("packet too short")
+		}
+		ihl := int(pkt[0]&0x0F) * 4
+		length := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if ihl < ipv4HeaderLen || length < ihl || length > len(pkt) {
+			return nil, fmt.Errorf("invalid IPv4 header")
+		}
+		flagsFrag := binary.BigEndian.Uint16(pkt[6:8])
+		return &ipHeader{
+			Version:  4,
+			Src:      netip.AddrFrom4([4]byte(pkt[12:16])),
+			Dst:      netip.AddrFrom4([4]byte(pkt[16:20])),
+			Protocol: pkt[9],
+			Offset:   ihl,
+			Length:   length,
+			Fragment: flagsFrag&0x2000 != 0 || flagsFrag&0x1FFF != 0,
+		}, nil
+	case 6:
+		if len(pkt) < ipv6HeaderLen {
+			return nil, fmt.Errorf("packet too short")
+		}
+		length := ipv6HeaderLen + int(binary.BigEndian.Uint16(pkt[4:6]))
+		if length > len(pkt) {
+			return nil, fmt.Errorf("invalid IPv6 payload length")
+		}
+		hdr := &ipHeader{
+			Version: 6,
+			Src:     netip.AddrFrom16([16]byte(pkt[8:24])),
+			Dst:     netip.AddrFrom16([16]byte(pkt[24:40])),
+			Length:  length,
+		}
+		next, off := pkt[6], ipv6HeaderLen
+		for {
+			switch next {
+			case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+				if off+8 > length {
+					return nil, fmt.Errorf("truncated IPv6 extension header")
+				}
+				next, off = pkt[off], off+(int(pkt[off+1])+1)*8
+			case ipv6AuthHeader:
+				if off+8 > length {
+					return nil, fmt.Errorf("truncated IPv6 extension header")
+				}
+				next, off = pkt[off], off+(int(pkt[off+1])+2)*4
+			case ipv6Fragment:
+				if off+8 > length {
+					return nil, fmt.Errorf("truncated IPv6 extension header")
+				}
+				hdr.Fragment = true
+				next, off = pkt[off], off+8
+			default:
+				if off > length {
+					return nil, fmt.Errorf("truncated IPv6 extension header")
+				}
+				hdr.Protocol, hdr.Offset = next, off
+				return hdr, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown IP version %d", pkt[0]>>4)
+	}
+}
+
+// udpPacket is a UDP datagram extracted from a raw IP packet.
+type udpPacket struct {
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Payload []byte
+}
+
+// parseUDPPacket extracts the addresses and payload of an IPv4 or IPv6 UDP
+// packet.
+func parseUDPPacket(pkt []byte) (*udpPacket, error) {
+	hdr, err := parseIPHeader(pkt)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Protocol != protoUDP {
+		return nil, fmt.Errorf("not a UDP packet")
+	}
+	if hdr.Fragment {
+		return nil, fmt.Errorf("fragmented UDP packets are not supported")
+	}
+	if hdr.Length < hdr.Offset+udpHeaderLen {
+		return nil, fmt.Errorf("not enough data for UDP header")
+	}
+	udp := pkt[hdr.Offset:hdr.Length]
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < udpHeaderLen || udpLen > len(udp) {
+		return nil, fmt.Errorf("invalid UDP length %d", udpLen)
+	}
+	return &udpPacket{
+		Src:     netip.AddrPortFrom(hdr.Src, binary.BigEndian.Uint16(udp[0:2])),
+		Dst:     netip.AddrPortFrom(hdr.Dst, binary.BigEndian.Uint16(udp[2:4])),
+		Payload: udp[udpHeaderLen:udpLen],
+	}, nil
+}
+
+// buildUDPPacket wraps payload in IP and UDP headers with valid checksums.
+// Both addresses must belong to the same family.
+func buildUDPPacket(src, dst netip.AddrPort, payload []byte) ([]byte, error) {
+	udpLen := udpHeaderLen + len(payload)
+	if udpLen > 0xFFFF {
+		return nil, fmt.Errorf("payload too large")
+	}
+	pkt, err := buildIPHeader(src.Addr(), dst.Addr(), protoUDP, udpLen)
+	if err != nil {
+		return nil, err
+	}
+	hdrLen := len(pkt)
+	pkt = pkt[:hdrLen+udpLen]
+
+	udp := pkt[hdrLen:]
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpLen))
+	copy(udp[udpHeaderLen:], payload)
+
+	sum := transportChecksum(src.Addr(), dst.Addr(), protoUDP, udp)
+	if sum == 0 {
+		sum = 0xFFFF // A zero checksum means "no checksum" in UDP.
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return pkt, nil
+}
+
+// buildIPHeader returns an IPv4 or IPv6 header for a packet carrying
+// payloadLen bytes of proto, with enough capacity to append the payload.
+func buildIPHeader(src, dst netip.Addr, proto uint8, payloadLen int) ([]byte, error) {
+	switch {
+	case src.Is4() && dst.Is4():
+		total := ipv4HeaderLen + payloadLen
+		if total > 0xFFFF {
+			return nil, fmt.Errorf("payload too large")
+		}
+		pkt := make([]byte, ipv4HeaderLen, total)
+		pkt[0] = 0x45 // Version 4, IHL 5
+		binary.BigEndian.PutUint16(pkt[2:], uint16(total))
+		pkt[6] = 0x40 // Don't fragment
+		pkt[8] = 64   // TTL
+		pkt[9] = proto
+		srcIP, dstIP := src.As4(), dst.As4()
+		copy(pkt[12:16], srcIP[:])
+		copy(pkt[16:20], dstIP[:])
+		binary.BigEndian.PutUint16(pkt[10:], checksum(pkt))
+		return pkt, nil
+	case src.Is6() && dst.Is6():
+		if payloadLen > 0xFFFF {
+			return nil, fmt.Errorf("payload too large")
+		}
+		pkt := make([]byte, ipv6HeaderLen, ipv6HeaderLen+payloadLen)
+		pkt[0] = 0x60 // Version 6
+		binary.BigEndian.PutUint16(pkt[4:], uint16(payloadLen))
+		pkt[6] = proto
+		pkt[7] = 64 // Hop limit
+		srcIP, dstIP := src.As16(), dst.As16()
+		copy(pkt[8:24], srcIP[:])
+		copy(pkt[24:40], dstIP[:])
+		return pkt, nil
+	default:
+		return nil, fmt.Errorf("mismatched address families %s and %s", src, dst)
+	}
+}
+
+// transportChecksum computes the checksum of a TCP, UDP or ICMPv6 segment,
+// including the pseudo-header of the enclosing IPv4 or IPv6 packet. The
+// checksum field of segment must be zero.
+func transportChecksum(src, dst netip.Addr, proto uint8, segment []byte) uint16 {
+	var pseudo []byte
+	if src.Is4() {
+		srcIP, dstIP := src.As4(), dst.As4()
+		pseudo = make([]byte, 0, 12+len(segment))
+		pseudo = append(pseudo, srcIP[:]...)
+		pseudo = append(pseudo, dstIP[:]...)
+		pseudo = append(pseudo, 0, proto)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		srcIP, dstIP := src.As16(), dst.As16()
+		pseudo = make([]byte, 0, 40+len(segment))
+		pseudo = append(pseudo, srcIP[:]...)
+		pseudo = append(pseudo, dstIP[:]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, proto)
+	}
+	pseudo = append(pseudo, segment...)
+	return checksum(pseudo)
+}
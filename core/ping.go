@@ -1,23 +1,54 @@
 package core
 
 import (
+	"context"
 	"fmt"
-	"net"
+	"net/http"
 	"time"
 
 	"github.com/amirhosseinghanipour/nekogo/config"
 )
 
-// TestServerLatency measures the TCP handshake time to a server.
-func TestServerLatency(server config.ServerConfig) (time.Duration, error) {
-	address := fmt.Sprintf("%s:%d", server.Address, server.Port)
-	start := time.Now()
+// LatencyTestURL is fetched through a server to measure its latency.
+const LatencyTestURL = "http://www.gstatic.com/generate_204"
+
+// TestServerLatency measures the time to fetch LatencyTestURL through
+// cfg.Servers[index], including its detour servers.
+func TestServerLatency(cfg *config.AppConfig, index int) (time.Duration, error) {
+	dialer, err := NewChainedOutbound(cfg, index)
+	if err != nil {
+		return 0, err
+	}
+	defer closeOutbound(dialer)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return URLTest(ctx, dialer, LatencyTestURL)
+}
 
-	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+// URLTest measures how long it takes to get a response for url through dialer.
+func URLTest(ctx context.Context, dialer Dialer, url string) (time.Duration, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialer.DialContext,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return 0, err
 	}
-	conn.Close()
 
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return 0, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
 	return time.Since(start), nil
 }
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// findProcess returns the executable of the process that owns the local
+// socket bound to src. The socket is looked up in /proc/net by address, and
+// its owner by scanning the file descriptors in /proc/*/fd.
+func findProcess(network string, src netip.AddrPort) (string, error) {
+	inode, err := socketInode(network, src)
+	if err != nil {
+		return "", err
+	}
+	link := "socket:[" + inode + "]"
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return "", err
+	}
+	for _, p := range procs {
+		if _, err := strconv.Atoi(p.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join("/proc", p.Name())
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue // gone, or not ours to look at
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(dir, "fd", fd.Name())); err == nil && target == link {
+				return os.Readlink(filepath.Join(dir, "exe"))
+			}
+		}
+	}
+	return "", fmt.Errorf("no process owns socket %s", inode)
+}
+
+// socketInode finds the inode of the socket bound to src in the /proc/net
+// tables of network. Unconnected UDP sockets bound to the wildcard address
+// match by port.
+func socketInode(network string, src netip.AddrPort) (string, error) {
+	for _, table := range []string{network, network + "6"} {
+		f, err := os.Open(filepath.Join("/proc/net", table))
+		if err != nil {
+			continue
+		}
+		inode, err := findSocket(f, network, src)
+		f.Close()
+		if err == nil {
+			return inode, nil
+		}
+	}
+	return "", fmt.Errorf("no %s socket bound to %s", network, src)
+}
+
+func findSocket(f *os.File, network string, src netip.AddrPort) (string, error) {
+	s := bufio.NewScanner(f)
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err := parseProcNetAddr(fields[1])
+		if err != nil || local.Port() != src.Port() {
+			continue
+		}
+		addr := local.Addr().Unmap()
+		if addr == src.Addr() || network == "udp" && addr.IsUnspecified() {
+			return fields[9], nil
+		}
+	}
+	return "", errors.New("not found")
+}
+
+// parseProcNetAddr parses an address of /proc/net/{tcp,udp}{,6}: the IP in
+// hex as 32-bit words in host byte order, a colon and the port in hex.
+func parseProcNetAddr(s string) (netip.AddrPort, error) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || len(raw) != 4 && len(raw) != 16 {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(raw[i:], binary.NativeEndian.Uint32(raw[i:]))
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	ip, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
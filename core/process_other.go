@@ -0,0 +1,15 @@
+//go:build !linux
+
+package core
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+)
+
+// findProcess is only implemented on Linux; process rules match nothing
+// elsewhere.
+func findProcess(network string, src netip.AddrPort) (string, error) {
+	return "", fmt.Errorf("process lookup is not supported on %s", runtime.GOOS)
+}
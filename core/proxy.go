@@ -1,74 +1,217 @@
 package core
 
 import (
+	"bufio"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"sync"
+	"time"
 
-	"github.com/armon/go-socks5"
+	"github.com/amirhosseinghanipour/nekogo/config"
 )
 
-func StartProxy(proxyType, addr string) error {
-	switch proxyType {
-	case "socks5":
-		conf := &socks5.Config{}
-		srv, err := socks5.New(conf)
+// Proxy is a set of running local inbound listeners that forward every
+// accepted connection through the outbound chosen by the routing rules.
+type Proxy struct {
+	outbounds *Outbounds
+	dialer    Dialer
+	listeners []net.Listener
+	http      *http.Server
+	httpConns *chanListener
+	transport *http.Transport
+	dns       *DNSServer // nil unless the config has a DNS listen address
+	resolver  *DNS       // nil unless the config has DNS servers
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// StartProxy opens the inbound listeners configured in cfg and starts
+// relaying as routed by its rules. Call Stop on the returned Proxy to
+// close them.
+func StartProxy(cfg *config.AppConfig) (*Proxy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	outbounds := NewOutbounds(cfg)
+	active, err := outbounds.Active()
+	if err != nil {
+		outbounds.Close()
+		return nil, err
+	}
+	dialer, err := NewRouter(cfg, outbounds, active)
+	if err != nil {
+		outbounds.Close()
+		return nil, err
+	}
+
+	p := &Proxy{
+		outbounds: outbounds,
+		dialer:    dialer,
+		resolver:  dialer.DNS(),
+		httpConns: newChanListener(),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	p.transport = &http.Transport{
+		DialContext:        dialer.DialContext,
+		DisableCompression: true,
+		IdleConnTimeout:    90 * time.Second,
+	}
+	p.http = &http.Server{Handler: p}
+	go p.http.Serve(p.httpConns)
+
+	for _, in := range cfg.ProxyInbounds() {
+		var handler func(net.Conn)
+		switch in.Type {
+		case "socks5":
+			handler = func(conn net.Conn) { p.serveSocks(conn, bufio.NewReader(conn)) }
+		case "http":
+			handler = p.httpConns.push
+		case "mixed":
+			handler = p.serveMixed
+		default:
+			p.Stop()
+			return nil, fmt.Errorf("unsupported inbound type: %s", in.Type)
+		}
+		ln, err := net.Listen("tcp", in.Listen)
+		if err != nil {
+			p.Stop()
+			return nil, fmt.Errorf("failed to listen on %s: %w", in.Listen, err)
+		}
+		p.listeners = append(p.listeners, ln)
+		log.Printf("%s proxy listening on %s", in.Type, ln.Addr())
+		go p.serve(ln, handler)
+	}
+	if cfg.DNS.Listen != "" {
+		if p.dns, err = ListenDNS(dialer.DNS(), cfg.DNS.Listen); err != nil {
+			p.Stop()
+			return nil, err
+		}
+	}
+	setRunning(nil, outbounds)
+	setDirectDNS(nil, p.resolver)
+	return p, nil
+}
+
+func (p *Proxy) serve(ln net.Listener, handler func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
 		if err != nil {
-			return fmt.Errorf("failed to create SOCKS5 server: %w", err)
+			return
 		}
-		go func() {
-			log.Printf("SOCKS5 proxy listening on %s", addr)
-			if err := srv.ListenAndServe("tcp", addr); err != nil {
-				log.Printf("SOCKS5 proxy error: %v", err)
-			}
-		}()
-	case "http":
-		proxy := &httputil.ReverseProxy{Director: func(req *http.Request) {}}
-		go func() {
-			log.Printf("HTTP proxy listening on %s", addr)
-			if err := http.ListenAndServe(addr, proxy); err != nil {
-				log.Printf("HTTP proxy error: %v", err)
-			}
-		}()
-	case "https":
-		// HTTPS proxy (CONNECT tunnel, no MITM)
-		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == http.MethodConnect {
-				// Handle CONNECT
-				log.Printf("HTTPS CONNECT %s", r.Host)
-				conn, err := net.Dial("tcp", r.Host)
-				if err != nil {
-					http.Error(w, "Failed to connect to target", http.StatusServiceUnavailable)
-					return
-				}
-				hj, ok := w.(http.Hijacker)
-				if !ok {
-					http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-					return
-				}
-				clientConn, _, err := hj.Hijack()
-				if err != nil {
-					http.Error(w, "Hijack failed", http.StatusInternalServerError)
-					return
-				}
-				clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-				go func() { io.Copy(conn, clientConn) }()
-				go func() { io.Copy(clientConn, conn) }()
-			} else {
-				w.WriteHeader(http.StatusMethodNotAllowed)
-			}
-		})
-		go func() {
-			log.Printf("HTTPS proxy (CONNECT) listening on %s", addr)
-			if err := http.ListenAndServe(addr, handler); err != nil {
-				log.Printf("HTTPS proxy error: %v", err)
-			}
-		}()
+		go handler(p.track(conn))
+	}
+}
+
+// Stop closes all listeners and every connection still being relayed.
+func (p *Proxy) Stop() error {
+	p.mu.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = make(map[net.Conn]struct{})
+	p.mu.Unlock()
+
+	for _, ln := range p.listeners {
+		ln.Close()
+	}
+	if p.dns != nil {
+		p.dns.Close()
+	}
+	err := p.http.Close()
+	p.transport.CloseIdleConnections()
+	for conn := range conns {
+		conn.Close()
+	}
+	setRunning(p.outbounds, nil)
+	setDirectDNS(p.resolver, nil)
+	p.outbounds.Close()
+	log.Println("Proxy mode stopped.")
+	return err
+}
+
+// track registers conn so that Stop can close it. The returned conn removes
+// itself from the set when closed.
+func (p *Proxy) track(conn net.Conn) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		conn.Close()
+		return conn
+	}
+	p.conns[conn] = struct{}{}
+	return &trackedConn{Conn: conn, proxy: p}
+}
+
+type trackedConn struct {
+	net.Conn
+	proxy *Proxy
+}
+
+func (c *trackedConn) Close() error {
+	c.proxy.mu.Lock()
+	delete(c.proxy.conns, c.Conn)
+	c.proxy.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) CloseWrite() error {
+	return forwardCloseWrite(c.Conn)
+}
+
+// serveMixed sniffs the first byte of conn to tell SOCKS from HTTP clients
+// and hands it to the matching handler.
+func (p *Proxy) serveMixed(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	ver, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	switch ver[0] {
+	case socks4Version, socks5Version:
+		p.serveSocks(conn, br)
 	default:
-		return fmt.Errorf("unsupported proxy type: %s", proxyType)
+		p.httpConns.push(newBufferedConn(conn, br))
 	}
+}
+
+// chanListener is a net.Listener fed with connections accepted elsewhere,
+// which lets the HTTP server handle connections from any inbound.
+type chanListener struct {
+	conns  chan net.Conn
+	done   chan struct{}
+	closer sync.Once
+}
+
+func newChanListener() *chanListener {
+	return &chanListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *chanListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.closer.Do(func() { close(l.done) })
 	return nil
 }
+
+func (l *chanListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
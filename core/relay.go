@@ -0,0 +1,118 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayLinger is how long the remaining direction of a relay may be idle
+// once the other direction is done but could not be passed on with a
+// half-close.
+const relayLinger = 30 * time.Second
+
+// closeWriter is implemented by connections that support half-close.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies data in both directions between a local connection and its
+// upstream until both sides are done, accounting the traffic in Stats.
+// When one direction ends, the other side is half-closed; if it cannot be,
+// the other direction carries on until it has been idle for relayLinger.
+func relay(local, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var localIdle, upstreamIdle atomic.Bool // reads are on an idle deadline
+	go func() {
+		defer wg.Done()
+		copyRelayed(upstream, local, AddBytesSent, &localIdle)
+		if !closeWrite(upstream) {
+			upstreamIdle.Store(true)
+			upstream.SetReadDeadline(time.Now().Add(relayLinger))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		copyRelayed(local, upstream, AddBytesReceived, &upstreamIdle)
+		if !closeWrite(local) {
+			localIdle.Store(true)
+			local.SetReadDeadline(time.Now().Add(relayLinger))
+		}
+	}()
+	wg.Wait()
+}
+
+// copyRelayed is copyCounted that pushes back the read deadline of src
+// after each chunk once idle is set.
+func copyRelayed(dst io.Writer, src net.Conn, count func(int64), idle *atomic.Bool) error {
+	return copyCounted(dst, src, func(n int64) {
+		count(n)
+		if idle.Load() {
+			src.SetReadDeadline(time.Now().Add(relayLinger))
+		}
+	})
+}
+
+// copyCounted is io.Copy that reports every chunk as it is written, so the
+// transfer rates stay accurate for long-lived connections.
+func copyCounted(dst io.Writer, src io.Reader, count func(int64)) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			count(int64(n))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// closeWrite signals EOF to the peer of conn and reports whether it could.
+func closeWrite(conn net.Conn) bool {
+	cw, ok := conn.(closeWriter)
+	return ok && cw.CloseWrite() == nil
+}
+
+// forwardCloseWrite is the CloseWrite of connections wrapping conn. It
+// half-closes conn, or returns errors.ErrUnsupported.
+func forwardCloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader, so that
+// bytes read ahead while parsing a handshake are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newBufferedConn returns conn itself when r holds no buffered data.
+func newBufferedConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return forwardCloseWrite(c.Conn)
+}
@@ -0,0 +1,454 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+// errBlocked is returned for connections routed to the "block" action.
+var errBlocked = errors.New("blocked by routing rule")
+
+// Router is the outbound used by inbounds. It routes each connection by the
+// config's rules to the active server or group, directly, to a named server
+// or group, or nowhere.
+type Router struct {
+	rules     []rule
+	outbounds *Outbounds
+	proxy     Dialer
+	dns       *DNS // nil if no DNS servers are configured
+
+	// lookupIP resolves domain names for IP rules.
+	lookupIP func(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+type rule struct {
+	config.RuleConfig
+	match func(m *metadata) bool
+}
+
+// NewRouter compiles the rules of cfg. Connections that match no rule, or
+// a rule with the "proxy" action, go through proxy.
+func NewRouter(cfg *config.AppConfig, outbounds *Outbounds, proxy Dialer) (*Router, error) {
+	r := &Router{
+		outbounds: outbounds,
+		proxy:     proxy,
+		lookupIP: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+	}
+	dbs, err := loadRuleDatabases(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for i, rc := range cfg.Rules {
+		match, err := compileRule(rc, dbs)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		r.rules = append(r.rules, rule{RuleConfig: rc, match: match})
+	}
+	if len(cfg.DNS.Servers) > 0 {
+		if r.dns, err = newDNS(cfg, r, dbs); err != nil {
+			return nil, err
+		}
+		r.lookupIP = r.dns.LookupIP
+	}
+	return r, nil
+}
+
+// DNS returns the resolver configured in the config's dns section, or nil
+// if there is none.
+func (r *Router) DNS() *DNS {
+	return r.dns
+}
+
+func (r *Router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d, err := r.route(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+func (r *Router) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	d, err := r.route(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.ListenPacket(ctx, addr)
+}
+
+// route returns the outbound for a connection to addr over network.
+func (r *Router) route(ctx context.Context, network, addr string) (Dialer, error) {
+	if len(r.rules) == 0 {
+		return r.proxy, nil
+	}
+	m, err := r.metadata(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range r.rules {
+		if rule.match(m) {
+			log.Printf("Rule %d (%s) routes %s %s to %s", i+1, rule.Type, network, addr, rule.Action)
+			return r.outbound(rule.Action)
+		}
+	}
+	return r.proxy, nil
+}
+
+func (r *Router) outbound(action string) (Dialer, error) {
+	switch action {
+	case "proxy":
+		return r.proxy, nil
+	case "direct":
+		return Direct, nil
+	case "block":
+		return nil, errBlocked
+	}
+	return r.outbounds.Get(action)
+}
+
+func (r *Router) metadata(ctx context.Context, network, addr string) (*metadata, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+	m := &metadata{ctx: ctx, router: r, network: network, port: uint16(port)}
+	if isTCP(network) {
+		m.network = "tcp"
+	}
+	sniffed := sniffedFrom(ctx)
+	m.protocol = sniffed.Protocol
+	if ip, err := netip.ParseAddr(host); err == nil {
+		m.ip = ip.Unmap()
+		m.resolved = true
+		m.domain = sniffed.Domain
+	} else {
+		m.domain = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	m.src, _ = sourceFrom(ctx)
+	return m, nil
+}
+
+// metadata is what rules know about a connection. The destination address
+// of a domain and the local process are only looked up if a rule needs them.
+// When the destination is an IP address, domain rules match the sniffed
+// domain while IP rules keep matching the address.
+type metadata struct {
+	ctx      context.Context
+	router   *Router
+	network  string // "tcp" or "udp"
+	domain   string // "" if the destination is an IP address and no domain was sniffed
+	protocol string // sniffed protocol, if any
+	port     uint16
+	src      netip.AddrPort // invalid if unknown
+
+	ip       netip.Addr
+	resolved bool
+
+	process       string
+	processLooked bool
+}
+
+// dstIP returns the destination address, resolving the domain if needed.
+func (m *metadata) dstIP() netip.Addr {
+	if !m.resolved {
+		m.resolved = true
+		if ips, err := m.router.lookupIP(m.ctx, m.domain); err == nil && len(ips) > 0 {
+			m.ip = ips[0].Unmap()
+		}
+	}
+	return m.ip
+}
+
+// processPath returns the executable of the local program that opened the
+// connection, or "" if it is not known.
+func (m *metadata) processPath() string {
+	if !m.processLooked {
+		m.processLooked = true
+		if m.src.IsValid() {
+			m.process, _ = findProcess(m.network, m.src)
+		}
+	}
+	return m.process
+}
+
+// ruleDatabases holds the GeoIP database and the geosite lists used by
+// rules.
+type ruleDatabases struct {
+	geoIP    *GeoIP
+	geoSites map[string]*DomainSet
+}
+
+// loadRuleDatabases loads the databases that the routing and DNS rules of
+// cfg use. Only the geosite lists named by rules are kept.
+func loadRuleDatabases(cfg *config.AppConfig) (*ruleDatabases, error) {
+	dbs := &ruleDatabases{}
+	var lists []string
+	for _, rc := range slices.Concat(cfg.Rules, cfg.DNS.Rules) {
+		switch rc.Type {
+		case "geoip":
+			if dbs.geoIP == nil {
+				db, err := LoadGeoIP(cfg.GeoIPPath)
+				if err != nil {
+					return nil, fmt.Errorf("failed to load GeoIP database: %w", err)
+				}
+				dbs.geoIP = db
+			}
+		case "geosite":
+			for _, v := range rc.Values {
+				lists = append(lists, strings.TrimSpace(v))
+			}
+		}
+	}
+	if len(lists) > 0 {
+		sets, err := LoadGeoSite(cfg.GeoSitePath, lists)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load geosite lists: %w", err)
+		}
+		dbs.geoSites = sets
+	}
+	return dbs, nil
+}
+
+func compileRule(rc config.RuleConfig, dbs *ruleDatabases) (func(m *metadata) bool, error) {
+	values := make([]string, len(rc.Values))
+	for i, v := range rc.Values {
+		values[i] = strings.TrimSpace(v)
+	}
+	switch rc.Type {
+	case "domain":
+		set := make(map[string]bool)
+		for _, v := range values {
+			set[strings.ToLower(strings.TrimSuffix(v, "."))] = true
+		}
+		return func(m *metadata) bool { return m.domain != "" && set[m.domain] }, nil
+	case "domain_suffix":
+		suffixes := make([]string, len(values))
+		for i, v := range values {
+			suffixes[i] = strings.ToLower(strings.Trim(v, "."))
+		}
+		return func(m *metadata) bool {
+			for _, s := range suffixes {
+				if m.domain == s || strings.HasSuffix(m.domain, "."+s) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "domain_keyword":
+		keywords := make([]string, len(values))
+		for i, v := range values {
+			keywords[i] = strings.ToLower(v)
+		}
+		return func(m *metadata) bool {
+			for _, k := range keywords {
+				if m.domain != "" && strings.Contains(m.domain, k) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "domain_regex":
+		res := make([]*regexp.Regexp, len(values))
+		for i, v := range values {
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = re
+		}
+		return func(m *metadata) bool {
+			for _, re := range res {
+				if m.domain != "" && re.MatchString(m.domain) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "ip_cidr":
+		prefixes, err := parsePrefixes(values)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *metadata) bool { return prefixesContain(prefixes, m.dstIP()) }, nil
+	case "src_ip_cidr":
+		prefixes, err := parsePrefixes(values)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *metadata) bool { return prefixesContain(prefixes, m.src.Addr().Unmap()) }, nil
+	case "dst_port":
+		ranges, err := parsePortRanges(values)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *metadata) bool {
+			for _, r := range ranges {
+				if m.port >= r[0] && m.port <= r[1] {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "network":
+		var tcp, udp bool
+		for _, v := range values {
+			switch strings.ToLower(v) {
+			case "tcp":
+				tcp = true
+			case "udp":
+				udp = true
+			default:
+				return nil, fmt.Errorf("unsupported network: %s", v)
+			}
+		}
+		return func(m *metadata) bool { return m.network == "tcp" && tcp || m.network == "udp" && udp }, nil
+	case "geoip":
+		countries := make(map[string]bool)
+		for _, v := range values {
+			countries[strings.ToLower(v)] = true
+		}
+		return func(m *metadata) bool {
+			ip := m.dstIP()
+			return ip.IsValid() && countries[dbs.geoIP.Country(ip)]
+		}, nil
+	case "geosite":
+		sets := make([]*DomainSet, len(values))
+		for i, v := range values {
+			sets[i] = dbs.geoSites[strings.ToLower(v)]
+		}
+		return func(m *metadata) bool {
+			for _, s := range sets {
+				if s.Match(m.domain) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "protocol":
+		protocols := make(map[string]bool)
+		for _, v := range values {
+			protocols[strings.ToLower(v)] = true
+		}
+		return func(m *metadata) bool { return protocols[m.protocol] }, nil
+	case "process":
+		return func(m *metadata) bool {
+			path := m.processPath()
+			if path == "" {
+				return false
+			}
+			for _, v := range values {
+				if matchProcess(v, path) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported type: %s", rc.Type)
+}
+
+// matchProcess reports whether a process rule value matches the executable
+// at path. Values with a directory are compared with the whole path, others
+// with the file name.
+func matchProcess(value, path string) bool {
+	if runtime.GOOS == "windows" {
+		if strings.ContainsAny(value, `/\`) {
+			return strings.EqualFold(value, path)
+		}
+		name := filepath.Base(path)
+		return strings.EqualFold(value, name) || strings.EqualFold(value, strings.TrimSuffix(name, filepath.Ext(name)))
+	}
+	if strings.Contains(value, "/") {
+		return value == path
+	}
+	return value == filepath.Base(path)
+}
+
+// parsePrefixes parses CIDR prefixes. Plain addresses match only
+// themselves.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, len(values))
+	for i, v := range values {
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes[i] = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes[i] = p.Masked()
+	}
+	return prefixes, nil
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRanges parses ports and port ranges such as "8000-9000".
+func parsePortRanges(values []string) ([][2]uint16, error) {
+	ranges := make([][2]uint16, len(values))
+	for i, v := range values {
+		lo, hi, isRange := strings.Cut(v, "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", v)
+		}
+		to, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("invalid port range: %s", v)
+		}
+		ranges[i] = [2]uint16{uint16(from), uint16(to)}
+	}
+	return ranges, nil
+}
+
+type sourceKey struct{}
+
+// withSource records in ctx the address a connection comes from, for rules
+// that match on the source or the local process.
+func withSource(ctx context.Context, addr string) context.Context {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, sourceKey{}, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+}
+
+func sourceFrom(ctx context.Context) (netip.AddrPort, bool) {
+	ap, ok := ctx.Value(sourceKey{}).(netip.AddrPort)
+	return ap, ok
+}
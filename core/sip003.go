@@ -0,0 +1,144 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+// pluginStartTimeout bounds how long a SIP003 plugin may take to start
+// accepting connections.
+const pluginStartTimeout = 5 * time.Second
+
+// sip003Plugin runs a SIP003 plugin binary, such as obfs-local or
+// v2ray-plugin, as a local subprocess. The plugin listens on a local port
+// and carries the Shadowsocks stream to the server in its own format. It is
+// started on first use and restarted if it exits.
+type sip003Plugin struct {
+	name    string
+	options string
+	server  config.ServerConfig
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	local  string
+	done   chan struct{}
+	closed bool
+}
+
+func newSIP003Plugin(server config.ServerConfig) *sip003Plugin {
+	return &sip003Plugin{name: server.Plugin, options: server.PluginOpts, server: server}
+}
+
+// DialContext connects to the plugin's local port, starting the plugin if
+// it is not running.
+func (p *sip003Plugin) DialContext(ctx context.Context) (net.Conn, error) {
+	local, done, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	// A freshly started plugin needs a moment before it listens.
+	var d net.Dialer
+	deadline := time.Now().Add(pluginStartTimeout)
+	for {
+		conn, err := d.DialContext(ctx, "tcp", local)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("failed to connect to plugin %s: %w", p.name, err)
+		}
+		select {
+		case <-done:
+			return nil, fmt.Errorf("plugin %s exited", p.name)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// start runs the plugin unless it is already running, and returns its
+// local address and a channel closed when it exits.
+func (p *sip003Plugin) start() (string, <-chan struct{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return "", nil, net.ErrClosed
+	}
+	if p.cmd != nil {
+		select {
+		case <-p.done:
+		default:
+			return p.local, p.done, nil
+		}
+	}
+
+	port, err := freeTCPPort()
+	if err != nil {
+		return "", nil, err
+	}
+	cmd := exec.Command(p.name)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+p.server.Address,
+		"SS_REMOTE_PORT="+strconv.Itoa(p.server.Port),
+		"SS_LOCAL_HOST=127.0.0.1",
+		"SS_LOCAL_PORT="+strconv.Itoa(port),
+		"SS_PLUGIN_OPTIONS="+p.options,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return "", nil, fmt.Errorf("failed to start plugin %s: %w", p.name, err)
+	}
+	log.Printf("Started plugin %s (pid %d) for %s", p.name, cmd.Process.Pid, serverAddr(p.server))
+
+	done := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		close(done)
+		p.mu.Lock()
+		closed := p.closed
+		p.mu.Unlock()
+		if !closed {
+			log.Printf("Plugin %s exited: %v", p.name, err)
+		}
+	}()
+	p.cmd, p.done = cmd, done
+	p.local = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	return p.local, done, nil
+}
+
+// Close stops the plugin.
+func (p *sip003Plugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.cmd == nil {
+		return nil
+	}
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+	return p.cmd.Process.Kill()
+}
+
+// freeTCPPort returns a loopback TCP port that is currently unused.
+func freeTCPPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
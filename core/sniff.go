@@ -0,0 +1,296 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// sniffTimeout bounds how long a TCP connection's first bytes are waited
+	// for. Protocols where the server speaks first are relayed unsniffed
+	// after it.
+	sniffTimeout = 300 * time.Millisecond
+	sniffBufSize = 8 * 1024
+)
+
+var (
+	// errSniffMore means the data may match once more of it has arrived.
+	errSniffMore = errors.New("need more data")
+	errSniffNone = errors.New("no match")
+)
+
+// sniffResult is what sniffing learned about a connection: the protocol
+// ("tls", "http", "quic" or "bittorrent") and the domain name it is for, if
+// the protocol carries one.
+type sniffResult struct {
+	Protocol string
+	Domain   string
+}
+
+type sniffer func(b []byte) (sniffResult, error)
+
+var tcpSniffers = []sniffer{sniffTLS, sniffHTTP, sniffBitTorrent}
+
+// sniffTCP waits for the first bytes the client sends on conn and sniffs
+// them. The returned conn still yields every byte read.
+func sniffTCP(conn net.Conn) (net.Conn, sniffResult) {
+	br := bufio.NewReaderSize(conn, sniffBufSize)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var res sniffResult
+	for n := 1; n <= sniffBufSize; n = br.Buffered() + 1 {
+		if b, _ := br.Peek(n); len(b) < n {
+			break // timed out or closed
+		}
+		b, _ := br.Peek(br.Buffered())
+		var more bool
+		if res, more = sniffAny(tcpSniffers, b); !more {
+			break
+		}
+	}
+	// The sniffed bytes are copied out rather than read through br, which
+	// would hand the relay the deadline error of the last Peek.
+	sniffed, _ := br.Peek(br.Buffered())
+	if len(sniffed) == 0 {
+		return conn, res
+	}
+	return &sniffedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(bytes.Clone(sniffed)), conn)}, res
+}
+
+// sniffedConn is a net.Conn that yields the bytes consumed by sniffing
+// before reading on.
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *sniffedConn) CloseWrite() error {
+	return forwardCloseWrite(c.Conn)
+}
+
+// sniffPacket sniffs the first datagram of a UDP flow.
+func sniffPacket(b []byte) sniffResult {
+	res, _ := sniffAny([]sniffer{sniffQUIC, sniffBitTorrentUDP}, b)
+	return res
+}
+
+// sniffAny returns the result of the first sniffer that matches b, and
+// whether any sniffer could still match with more data.
+func sniffAny(sniffers []sniffer, b []byte) (sniffResult, bool) {
+	more := false
+	for _, sniff := range sniffers {
+		res, err := sniff(b)
+		if err == nil {
+			return res, false
+		}
+		if err == errSniffMore {
+			more = true
+		}
+	}
+	return sniffResult{}, more
+}
+
+// sniffTLS reads the server name of a TLS ClientHello record.
+func sniffTLS(b []byte) (sniffResult, error) {
+	if len(b) < 5 {
+		if len(b) > 0 && b[0] != 0x16 {
+			return sniffResult{}, errSniffNone
+		}
+		return sniffResult{}, errSniffMore
+	}
+	// Handshake record of TLS 1.0 or later.
+	if b[0] != 0x16 || b[1] != 3 {
+		return sniffResult{}, errSniffNone
+	}
+	recLen := int(binary.BigEndian.Uint16(b[3:5]))
+	rec := b[5:]
+	if len(rec) > recLen {
+		rec = rec[:recLen]
+	}
+	domain, err := clientHelloServerName(rec, len(rec) == recLen)
+	if err != nil {
+		return sniffResult{}, err
+	}
+	return sniffResult{Protocol: "tls", Domain: domain}, nil
+}
+
+// clientHelloServerName returns the server name of the ClientHello
+// handshake message at the start of b, which may hold only part of the
+// message if complete is false. Names found before the end of the data
+// count; otherwise errSniffMore asks for the rest.
+func clientHelloServerName(b []byte, complete bool) (string, error) {
+	more := errSniffMore
+	if complete {
+		more = errSniffNone
+	}
+	if len(b) < 4 {
+		return "", more
+	}
+	if b[0] != 0x01 { // client_hello
+		return "", errSniffNone
+	}
+	msgLen := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[4:]
+	if len(b) >= msgLen {
+		b, more = b[:msgLen], errSniffNone
+	}
+	// version, random
+	if len(b) < 34 {
+		return "", more
+	}
+	b = b[34:]
+	// session_id, cipher_suites, compression_methods
+	for _, lenSize := range []int{1, 2, 1} {
+		if len(b) < lenSize {
+			return "", more
+		}
+		n := int(b[0])
+		if lenSize == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < lenSize+n {
+			return "", more
+		}
+		b = b[lenSize+n:]
+	}
+	if len(b) < 2 {
+		return "", errSniffNone // no extensions
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b)
+		extLen := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+extLen {
+			return "", more
+		}
+		ext := b[4 : 4+extLen]
+		b = b[4+extLen:]
+		if extType != 0 { // server_name
+			continue
+		}
+		// server_name_list: name_type, then a host_name of type 0.
+		if len(ext) < 5 || ext[2] != 0 {
+			return "", errSniffNone
+		}
+		nameLen := int(binary.BigEndian.Uint16(ext[3:]))
+		if len(ext) < 5+nameLen || nameLen == 0 {
+			return "", errSniffNone
+		}
+		return strings.ToLower(string(ext[5 : 5+nameLen])), nil
+	}
+	return "", more
+}
+
+var httpMethods = []string{"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+
+// sniffHTTP reads the Host header of an HTTP/1 request.
+func sniffHTTP(b []byte) (sniffResult, error) {
+	sp := bytes.IndexByte(b, ' ')
+	if sp < 0 {
+		if len(b) > 8 {
+			return sniffResult{}, errSniffNone
+		}
+		for _, m := range httpMethods {
+			if strings.HasPrefix(m, string(b)) {
+				return sniffResult{}, errSniffMore
+			}
+		}
+		return sniffResult{}, errSniffNone
+	}
+	method := string(b[:sp])
+	known := false
+	for _, m := range httpMethods {
+		known = known || m == method
+	}
+	if !known {
+		return sniffResult{}, errSniffNone
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return sniffResult{}, errSniffMore
+	}
+	lines := strings.Split(string(b[:end]), "\r\n")
+	if !strings.Contains(lines[0], " HTTP/1.") {
+		return sniffResult{}, errSniffNone
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			break
+		}
+		res := sniffResult{Protocol: "http"}
+		if net.ParseIP(host) == nil {
+			res.Domain = strings.ToLower(host)
+		}
+		return res, nil
+	}
+	return sniffResult{Protocol: "http"}, nil
+}
+
+var bitTorrentHandshake = []byte("\x13BitTorrent protocol")
+
+// sniffBitTorrent recognizes the handshake of the BitTorrent peer protocol.
+func sniffBitTorrent(b []byte) (sniffResult, error) {
+	n := min(len(b), len(bitTorrentHandshake))
+	if !bytes.Equal(b[:n], bitTorrentHandshake[:n]) {
+		return sniffResult{}, errSniffNone
+	}
+	if n < len(bitTorrentHandshake) {
+		return sniffResult{}, errSniffMore
+	}
+	return sniffResult{Protocol: "bittorrent"}, nil
+}
+
+// sniffBitTorrentUDP recognizes DHT messages, which are bencoded
+// dictionaries, and uTP packets.
+func sniffBitTorrentUDP(b []byte) (sniffResult, error) {
+	if bytes.HasPrefix(b, []byte("d1:")) && bytes.HasSuffix(b, []byte("e")) &&
+		(bytes.Contains(b, []byte("1:y1:q")) || bytes.Contains(b, []byte("1:y1:r"))) {
+		return sniffResult{Protocol: "bittorrent"}, nil
+	}
+	// uTP: type ST_DATA to ST_SYN, version 1, and a 20-byte header followed
+	// by a well-formed extension chain.
+	if len(b) < 20 || b[0]>>4 > 4 || b[0]&0x0F != 1 {
+		return sniffResult{}, errSniffNone
+	}
+	for ext, rest := b[1], b[20:]; ext != 0; {
+		if ext > 2 || len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return sniffResult{}, errSniffNone
+		}
+		ext, rest = rest[0], rest[2+int(rest[1]):]
+	}
+	return sniffResult{Protocol: "bittorrent"}, nil
+}
+
+type sniffKey struct{}
+
+// withSniffed records in ctx what sniffing learned about a connection, for
+// the router.
+func withSniffed(ctx context.Context, res sniffResult) context.Context {
+	return context.WithValue(ctx, sniffKey{}, res)
+}
+
+func sniffedFrom(ctx context.Context) sniffResult {
+	res, _ := ctx.Value(sniffKey{}).(sniffResult)
+	return res
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// quicVersion holds what decrypting Initial packets differs in between
+// QUIC versions (RFC 9001 section 5.2, RFC 9369 section 3.3).
+type quicVersion struct {
+	salt        []byte
+	labelPrefix string
+	initialType byte // long header packet type of Initial packets
+}
+
+var quicVersions = map[uint32]quicVersion{
+	0x00000001: {
+		salt:        []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		labelPrefix: "quic ",
+		initialType: 0,
+	},
+	0x6b3343cf: {
+		salt:        []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		labelPrefix: "quicv2 ",
+		initialType: 1,
+	},
+}
+
+// sniffQUIC reads the server name of the TLS ClientHello carried in a
+// client's QUIC Initial packet. Initial packets are encrypted with keys
+// derived from the destination connection ID, so anyone can decrypt them.
+// Only the first packet of a flow is seen; if the ClientHello continues in
+// the next one, the name is found only if it comes early enough.
+func sniffQUIC(b []byte) (sniffResult, error) {
+	// Long header with the fixed bit set.
+	if len(b) < 7 || b[0]&0xC0 != 0xC0 {
+		return sniffResult{}, errSniffNone
+	}
+	ver, ok := quicVersions[binary.BigEndian.Uint32(b[1:5])]
+	if !ok || b[0]>>4&3 != ver.initialType {
+		return sniffResult{}, errSniffNone
+	}
+	p := 5
+	dcidLen := int(b[p])
+	if dcidLen > 20 || len(b) < p+1+dcidLen+1 {
+		return sniffResult{}, errSniffNone
+	}
+	dcid := b[p+1 : p+1+dcidLen]
+	p += 1 + dcidLen
+	p += 1 + int(b[p]) // source connection ID
+	if p > len(b) {
+		return sniffResult{}, errSniffNone
+	}
+	tokenLen, n := quicVarint(b[p:])
+	if n == 0 || uint64(len(b)-p-n) < tokenLen {
+		return sniffResult{}, errSniffNone
+	}
+	p += n + int(tokenLen)
+	length, n := quicVarint(b[p:])
+	if n == 0 || uint64(len(b)-p-n) < length {
+		return sniffResult{}, errSniffNone
+	}
+	p += n
+	pnOffset := p
+	end := p + int(length)
+	if end-pnOffset < 4+16 {
+		return sniffResult{}, errSniffNone
+	}
+
+	key, iv, hp := quicClientInitialKeys(ver, dcid)
+
+	// Remove header protection (RFC 9001 section 5.4).
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return sniffResult{}, errSniffNone
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, b[pnOffset+4:pnOffset+4+16])
+	hdr := slices.Clone(b[:pnOffset+4])
+	hdr[0] ^= mask[0] & 0x0F
+	pnLen := int(hdr[0]&3) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		hdr[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(hdr[pnOffset+i])
+	}
+	hdr = hdr[:pnOffset+pnLen]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return sniffResult{}, errSniffNone
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return sniffResult{}, errSniffNone
+	}
+	nonce := slices.Clone(iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := aead.Open(nil, nonce, b[pnOffset+pnLen:end], hdr)
+	if err != nil {
+		return sniffResult{}, errSniffNone
+	}
+
+	domain, err := clientHelloServerName(quicCryptoData(payload), false)
+	if err != nil {
+		return sniffResult{Protocol: "quic"}, nil
+	}
+	return sniffResult{Protocol: "quic", Domain: domain}, nil
+}
+
+// quicClientInitialKeys derives the key, IV and header protection key of a
+// client's Initial packets.
+func quicClientInitialKeys(ver quicVersion, dcid []byte) (key, iv, hp []byte) {
+	initial := hkdf.Extract(sha256.New, dcid, ver.salt)
+	client := hkdfExpandLabel(initial, "client in", 32)
+	return hkdfExpandLabel(client, ver.labelPrefix+"key", 16),
+		hkdfExpandLabel(client, ver.labelPrefix+"iv", 12),
+		hkdfExpandLabel(client, ver.labelPrefix+"hp", 16)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, length)
+	hkdf.Expand(sha256.New, secret, info).Read(out)
+	return out
+}
+
+// quicCryptoData reassembles the CRYPTO frames of a decrypted Initial
+// packet and returns the data from offset 0 for as long as it is
+// contiguous. Parsing stops at frames that clients do not send in Initial
+// packets.
+func quicCryptoData(b []byte) []byte {
+	type frame struct {
+		offset uint64
+		data   []byte
+	}
+	var frames []frame
+parse:
+	for len(b) > 0 {
+		typ, n := quicVarint(b)
+		if n == 0 {
+			break
+		}
+		b = b[n:]
+		switch typ {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			fields := 4 // largest acknowledged, delay, range count, first range
+			for i := 0; i < fields; i++ {
+				v, n := quicVarint(b)
+				if n == 0 {
+					break parse
+				}
+				b = b[n:]
+				if i == 2 {
+					fields += 2 * int(min(v, 1024)) // gap and length of each range
+				}
+			}
+			if typ == 0x03 {
+				for i := 0; i < 3; i++ { // ECN counts
+					_, n := quicVarint(b)
+					if n == 0 {
+						break parse
+					}
+					b = b[n:]
+				}
+			}
+		case 0x06: // CRYPTO
+			offset, n := quicVarint(b)
+			if n == 0 {
+				break parse
+			}
+			b = b[n:]
+			length, n := quicVarint(b)
+			if n == 0 || uint64(len(b)-n) < length {
+				break parse
+			}
+			b = b[n:]
+			frames = append(frames, frame{offset, b[:length]})
+			b = b[length:]
+		default:
+			break parse
+		}
+	}
+
+	slices.SortFunc(frames, func(a, b frame) int { return cmp.Compare(a.offset, b.offset) })
+	var data []byte
+	for _, f := range frames {
+		if f.offset > uint64(len(data)) {
+			break
+		}
+		if end := f.offset + uint64(len(f.data)); end > uint64(len(data)) {
+			data = append(data, f.data[uint64(len(data))-f.offset:]...)
+		}
+	}
+	return data
+}
+
+// quicVarint decodes a QUIC variable-length integer and returns it with its
+// size, which is 0 if b is too short.
+func quicVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3F)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
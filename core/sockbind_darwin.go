@@ -0,0 +1,18 @@
+package core
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToInterface binds the socket fd to the interface with the given index.
+func bindToInterface(fd uintptr, network string, index int) error {
+	if strings.HasSuffix(network, "6") {
+		// Dual-stack sockets carry IPv4 too; the option is not allowed on
+		// IPv6-only ones, so its error is ignored.
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, index)
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, index)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, index)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package core
+
+import "errors"
+
+// bindToInterface binds the socket fd to the interface with the given index.
+func bindToInterface(fd uintptr, network string, index int) error {
+	return errors.ErrUnsupported
+}
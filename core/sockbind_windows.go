@@ -0,0 +1,27 @@
+package core
+
+import (
+	"math/bits"
+	"strings"
+	"syscall"
+)
+
+// Socket options from ws2ipdef.h, missing from package syscall.
+const (
+	ipUnicastIf   = 31
+	ipv6UnicastIf = 31
+)
+
+// bindToInterface binds the socket fd to the interface with the given index.
+func bindToInterface(fd uintptr, network string, index int) error {
+	// IP_UNICAST_IF takes the index in network byte order, on little-endian
+	// hosts like all that Windows runs on.
+	index4 := int(bits.ReverseBytes32(uint32(index)))
+	if strings.HasSuffix(network, "6") {
+		// Dual-stack sockets carry IPv4 too; the option is not allowed on
+		// IPv6-only ones, so its error is ignored.
+		syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipUnicastIf, index4)
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6UnicastIf, index)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipUnicastIf, index4)
+}
@@ -0,0 +1,32 @@
+package core
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tunBypassMark is the firewall mark of the sockets NekoGo opens itself
+// while TUN mode routes traffic into the device. A policy rule routes
+// marked packets by the main table, so that they leave through a physical
+// interface instead of looping back into the device.
+const tunBypassMark = 0x2022
+
+// socketMark is the mark given to new sockets, or 0 for none.
+var socketMark atomic.Uint32
+
+// markSocket is the Control function of the sockets that Direct opens.
+func markSocket(network, address string, c syscall.RawConn) error {
+	mark := socketMark.Load()
+	if mark == 0 {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark))
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
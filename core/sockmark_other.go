@@ -0,0 +1,29 @@
+//go:build !linux
+
+package core
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+// boundInterface is the index of the physical interface that new sockets
+// are bound to while TUN mode routes traffic into the device, or 0 for
+// none. Bound sockets leave through that interface whatever the routes
+// say, so they cannot loop back into the device.
+var boundInterface atomic.Int32
+
+// markSocket is the Control function of the sockets that Direct opens.
+func markSocket(network, address string, c syscall.RawConn) error {
+	index := int(boundInterface.Load())
+	if index == 0 {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = bindToInterface(fd, network, index)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+package core
+
+import (
+	"log"
+
+	"golang.org/x/sys/unix"
+)
+
+// StartSystemTunnel makes the TUN device name the default route of the main
+// routing table.
+func StartSystemTunnel(name string) error {
+	log.Println("Setting system default route to TUN")
+	n, err := newLinuxNet()
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+	return n.addRoutes(name, defaultRoutes, unix.RT_TABLE_MAIN)
+}
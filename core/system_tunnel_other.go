@@ -0,0 +1,20 @@
+//go:build !linux
+
+package core
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func StartSystemTunnel(name string) error {
+	osType := runtime.GOOS
+	switch osType {
+	case "darwin":
+		return fmt.Errorf("System tunnel not implemented for macOS yet")
+	case "windows":
+		return fmt.Errorf("System tunnel not implemented for Windows yet")
+	default:
+		return fmt.Errorf("Unsupported OS: %s", osType)
+	}
+}
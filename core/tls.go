@@ -0,0 +1,135 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS client configuration for server.
+func tlsConfig(server config.ServerConfig) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName(server),
+		NextProtos:         server.ALPN,
+		InsecureSkipVerify: server.AllowInsecure,
+	}
+	if server.TLSMinVersion != "" {
+		v, ok := tlsVersions[server.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS minimum version: %s", server.TLSMinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if server.CAFile != "" {
+		pool, err := loadCAFile(server.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if len(server.PinSHA256) > 0 {
+		pins, err := parsePins(server.PinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(pinCandidates(cs, server.AllowInsecure), pins)
+		}
+	}
+	return cfg, nil
+}
+
+// serverName returns the TLS server name for server: its SNI if set,
+// otherwise its Host or address.
+func serverName(server config.ServerConfig) string {
+	if server.SNI != "" {
+		return server.SNI
+	}
+	return serverHost(server)
+}
+
+var (
+	caPoolsMu sync.Mutex
+	caPools   = make(map[string]*x509.CertPool)
+)
+
+// loadCAFile returns the certificate pool in a PEM bundle. Bundles are read
+// once and then cached by path.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	caPoolsMu.Lock()
+	defer caPoolsMu.Unlock()
+	if pool, ok := caPools[path]; ok {
+		return pool, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	caPools[path] = pool
+	return pool, nil
+}
+
+// parsePins decodes SHA-256 pins given in hex or base64.
+func parsePins(values []string) ([][]byte, error) {
+	pins := make([][]byte, 0, len(values))
+	for _, v := range values {
+		pin, err := hex.DecodeString(v)
+		if err != nil {
+			pin, err = base64.StdEncoding.DecodeString(v)
+		}
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 pin: %s", v)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// pinCandidates returns the certificates that pins may match. Anyone can
+// append the server's public certificate to their own chain, so these are
+// only the leaf when the chain is not verified, and otherwise only the
+// certificates of the verified chains.
+func pinCandidates(cs tls.ConnectionState, insecure bool) []*x509.Certificate {
+	if insecure {
+		return cs.PeerCertificates[:min(1, len(cs.PeerCertificates))]
+	}
+	var certs []*x509.Certificate
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	return certs
+}
+
+// verifyPins accepts certs if any of them, or of their public keys, has one
+// of the pinned SHA-256 hashes.
+func verifyPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		certHash := sha256.Sum256(cert.Raw)
+		keyHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin, certHash[:]) || bytes.Equal(pin, keyHash[:]) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("server certificate does not match any pinned hash")
+}
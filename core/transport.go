@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+// transportDialer opens a stream to server through dialer using one stream
+// transport, including the server's security layer. Transports that
+// multiplex streams over HTTP/2 share the connection kept in pool, which
+// belongs to the outbound.
+type transportDialer func(ctx context.Context, dialer Dialer, server config.ServerConfig, pool *h2Pool) (net.Conn, error)
+
+// transports maps ServerConfig.Network values to stream transports. It is
+// only written from init functions.
+var transports = make(map[string]transportDialer)
+
+func registerTransport(network string, dial transportDialer) {
+	transports[network] = dial
+}
+
+func init() {
+	registerTransport("", dialTCP)
+	registerTransport("tcp", dialTCP)
+}
+
+// dialTransport connects to server through dialer and sets up its stream
+// transport and security layer, returning the stream that the proxy
+// protocol runs over.
+func dialTransport(ctx context.Context, dialer Dialer, server config.ServerConfig, pool *h2Pool) (net.Conn, error) {
+	dial, ok := transports[server.Network]
+	if !ok {
+		return nil, fmt.Errorf("unsupported transport: %s", server.Network)
+	}
+	return dial(ctx, dialer, server, pool)
+}
+
+// checkTransport reports whether the transport and security layer of server
+// are supported.
+func checkTransport(server config.ServerConfig) error {
+	if _, ok := transports[server.Network]; !ok {
+		return fmt.Errorf("unsupported transport: %s", server.Network)
+	}
+	return checkSecurity(server)
+}
+
+// checkSecurity reports whether the security layer of server is supported
+// and its TLS settings are valid.
+func checkSecurity(server config.ServerConfig) error {
+	security, err := serverSecurity(server)
+	if err != nil {
+		return err
+	}
+	if security == "tls" {
+		_, err = tlsConfig(server)
+	}
+	return err
+}
+
+func dialTCP(ctx context.Context, dialer Dialer, server config.ServerConfig, _ *h2Pool) (net.Conn, error) {
+	return dialSecure(ctx, dialer, server, nil)
+}
+
+// dialSecure connects to server and applies its security layer. alpn is
+// offered in the TLS handshake unless the server configures its own.
+func dialSecure(ctx context.Context, dialer Dialer, server config.ServerConfig, alpn []string) (net.Conn, error) {
+	security, err := serverSecurity(server)
+	if err != nil {
+		return nil, err
+	}
+	var cfg *tls.Config
+	if security == "tls" {
+		if cfg, err = tlsConfig(server); err != nil {
+			return nil, err
+		}
+		if len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = alpn
+		}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", serverAddr(server))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial server: %w", err)
+	}
+	if cfg != nil {
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// serverSecurity returns the security layer of server: "tls", or "" for
+// none.
+func serverSecurity(server config.ServerConfig) (string, error) {
+	switch server.Security {
+	case "", "none":
+		if server.TLS {
+			return "tls", nil
+		}
+		return "", nil
+	case "tls":
+		return "tls", nil
+	default:
+		return "", fmt.Errorf("unsupported security: %s", server.Security)
+	}
+}
+
+// serverHost returns the HTTP host that transports send to server.
+func serverHost(server config.ServerConfig) string {
+	if server.Host != "" {
+		return server.Host
+	}
+	return server.Address
+}
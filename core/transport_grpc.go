@@ -0,0 +1,126 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() {
+	registerTransport("grpc", dialGRPC)
+}
+
+// dialGRPC opens a gRPC "gun" stream: a bidirectional streaming call to the
+// Tun method of the service named by server.Path, exchanging Hunk messages
+// that each carry a chunk of the stream. A path starting with "/" is used
+// as the full method path instead, as Xray does.
+func dialGRPC(ctx context.Context, dialer Dialer, server config.ServerConfig, pool *h2Pool) (net.Conn, error) {
+	cc, err := pool.get(ctx, dialer, server)
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + url.PathEscape(server.Path) + "/Tun"
+	if strings.HasPrefix(server.Path, "/") {
+		path, _, _ = strings.Cut(server.Path, "|")
+	}
+	host := serverHost(server)
+	req := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: cc.scheme, Host: host, Path: path},
+		Host:   host,
+		Header: http.Header{
+			"Content-Type": {"application/grpc"},
+			"Te":           {"trailers"},
+			"User-Agent":   {"grpc-go/1.65.0"},
+		},
+	}
+	stream := openH2Stream(cc, req)
+	return &grpcConn{h2Stream: stream, br: bufio.NewReader(stream)}, nil
+}
+
+// grpcConn frames the stream as gRPC messages holding a protobuf Hunk, whose
+// field 1 is the data.
+type grpcConn struct {
+	*h2Stream
+	br        *bufio.Reader
+	rmu       sync.Mutex
+	remaining int // unread data bytes of the current message
+	skip      int // bytes after the data in the current message
+}
+
+func (c *grpcConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.remaining == 0 {
+		if err := c.nextMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.br.Read(b[:min(len(b), c.remaining)])
+	c.remaining -= n
+	return n, err
+}
+
+// nextMessage parses the next message header. Like the WebSocket
+// transport, it only consumes input once the whole header is buffered.
+func (c *grpcConn) nextMessage() error {
+	if c.skip > 0 {
+		n, err := c.br.Discard(c.skip)
+		c.skip -= n
+		if err != nil {
+			return err
+		}
+	}
+	hdr, err := c.br.Peek(5)
+	if err != nil {
+		return err
+	}
+	if hdr[0] != 0 {
+		return fmt.Errorf("compressed gRPC messages are not supported")
+	}
+	size := int(binary.BigEndian.Uint32(hdr[1:]))
+	if size == 0 {
+		c.br.Discard(5)
+		return nil
+	}
+	// The Hunk header is a one-byte tag and a varint of at most 10 bytes.
+	hdr, err = c.br.Peek(5 + min(size, 11))
+	if err != nil {
+		return err
+	}
+	num, typ, tagLen := protowire.ConsumeTag(hdr[5:])
+	if tagLen < 0 || num != 1 || typ != protowire.BytesType {
+		return fmt.Errorf("invalid gRPC Hunk message")
+	}
+	dataLen, lenLen := protowire.ConsumeVarint(hdr[5+tagLen:])
+	// dataLen is compared before it is converted, since a huge varint
+	// would wrap to a negative int.
+	if lenLen < 0 || size-tagLen-lenLen < 0 || dataLen > uint64(size-tagLen-lenLen) {
+		return fmt.Errorf("invalid gRPC Hunk message")
+	}
+	c.br.Discard(5 + tagLen + lenLen)
+	c.remaining = int(dataLen)
+	c.skip = size - tagLen - lenLen - int(dataLen)
+	return nil
+}
+
+func (c *grpcConn) Write(b []byte) (int, error) {
+	size := 1 + protowire.SizeVarint(uint64(len(b))) + len(b)
+	msg := make([]byte, 5, 5+size)
+	binary.BigEndian.PutUint32(msg[1:], uint32(size))
+	msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, b)
+	if _, err := c.h2Stream.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+	"golang.org/x/net/http2"
+)
+
+func init() {
+	registerTransport("h2", dialHTTP2)
+	registerTransport("http", dialHTTP2)
+}
+
+// dialHTTP2 opens a stream as a PUT request to server.Path whose body
+// carries the upload and whose response body carries the download. Host may
+// list several comma-separated hosts, one of which is picked per stream.
+func dialHTTP2(ctx context.Context, dialer Dialer, server config.ServerConfig, pool *h2Pool) (net.Conn, error) {
+	cc, err := pool.get(ctx, dialer, server)
+	if err != nil {
+		return nil, err
+	}
+	hosts := strings.Split(serverHost(server), ",")
+	host := strings.TrimSpace(hosts[rand.IntN(len(hosts))])
+	path := server.Path
+	if path == "" {
+		path = "/"
+	}
+	req := &http.Request{
+		Method: http.MethodPut,
+		URL:    &url.URL{Scheme: cc.scheme, Host: host, Path: path},
+		Host:   host,
+		Header: make(http.Header),
+	}
+	return openH2Stream(cc, req), nil
+}
+
+type h2Conn struct {
+	*http2.ClientConn
+	scheme        string
+	local, remote net.Addr
+}
+
+// h2Pool keeps the HTTP/2 connection to the server of an outbound, over
+// which its gRPC and HTTP/2 transports multiplex all their streams.
+type h2Pool struct {
+	mu     sync.Mutex
+	conn   *h2Conn
+	closed bool
+}
+
+// get returns a connection to server that can take another stream, dialing
+// a new one if needed. The lock is held while dialing, so that streams
+// opened meanwhile share the new connection.
+func (p *h2Pool) get(ctx context.Context, dialer Dialer, server config.ServerConfig) (*h2Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, net.ErrClosed
+	}
+	// A closed connection that never carried a stream still claims it can
+	// take one.
+	if p.conn != nil && p.conn.CanTakeNewRequest() && !p.conn.State().Closed {
+		return p.conn, nil
+	}
+
+	security, err := serverSecurity(server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialSecure(ctx, dialer, server, []string{"h2"})
+	if err != nil {
+		return nil, err
+	}
+	t := &http2.Transport{
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+	client, err := t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start HTTP/2 connection: %w", err)
+	}
+	if old := p.conn; old != nil {
+		// The streams still open on the old connection may finish.
+		go old.Shutdown(context.Background())
+	}
+	p.conn = &h2Conn{ClientConn: client, scheme: "http", local: conn.LocalAddr(), remote: conn.RemoteAddr()}
+	if security == "tls" {
+		p.conn.scheme = "https"
+	}
+	return p.conn, nil
+}
+
+// Close closes the connection along with its streams.
+func (p *h2Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// h2Stream is a net.Conn over a streaming HTTP/2 request body and its
+// response body. The request is sent right away, but the response is only
+// awaited by Read, since servers may hold their headers back until they
+// have data to send.
+type h2Stream struct {
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	local  net.Addr
+	remote net.Addr
+
+	ready chan struct{}
+	body  io.ReadCloser
+	err   error
+
+	rmu          sync.Mutex
+	pending      chan h2Read
+	rbuf         []byte
+	rerr         error
+	readDeadline atomic.Pointer[time.Time]
+}
+
+type h2Read struct {
+	data []byte
+	err  error
+}
+
+func openH2Stream(cc *h2Conn, req *http.Request) *h2Stream {
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+	req.Body = pr
+	req.ContentLength = -1
+	s := &h2Stream{
+		pw:     pw,
+		cancel: cancel,
+		local:  cc.local,
+		remote: cc.remote,
+		ready:  make(chan struct{}),
+	}
+	go func() {
+		defer close(s.ready)
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			s.err = err
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			s.err = fmt.Errorf("unexpected HTTP/2 response: %s", resp.Status)
+			return
+		}
+		s.body = resp.Body
+	}()
+	return s
+}
+
+// Read honors the read deadline without giving up the stream: a read
+// still in progress when the deadline passes is picked up by the next
+// call.
+func (s *h2Stream) Read(b []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	if len(s.rbuf) == 0 {
+		if s.rerr != nil {
+			return 0, s.rerr
+		}
+		if s.pending == nil {
+			s.pending = make(chan h2Read, 1)
+			go s.readBody(s.pending)
+		}
+		var timeout <-chan time.Time
+		if d := s.readDeadline.Load(); d != nil {
+			timer := time.NewTimer(time.Until(*d))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case r := <-s.pending:
+			s.pending = nil
+			s.rbuf, s.rerr = r.data, r.err
+			if len(s.rbuf) == 0 {
+				return 0, s.rerr
+			}
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	n := copy(b, s.rbuf)
+	s.rbuf = s.rbuf[n:]
+	return n, nil
+}
+
+func (s *h2Stream) readBody(result chan<- h2Read) {
+	<-s.ready
+	if s.err != nil {
+		result <- h2Read{err: s.err}
+		return
+	}
+	buf := make([]byte, 32*1024)
+	n, err := s.body.Read(buf)
+	result <- h2Read{data: buf[:n], err: err}
+}
+
+func (s *h2Stream) Write(b []byte) (int, error) {
+	return s.pw.Write(b)
+}
+
+// CloseWrite ends the request body.
+func (s *h2Stream) CloseWrite() error {
+	return s.pw.Close()
+}
+
+func (s *h2Stream) Close() error {
+	s.pw.Close()
+	s.cancel()
+	go func() {
+		<-s.ready
+		if s.body != nil {
+			s.body.Close()
+		}
+	}()
+	return nil
+}
+
+func (s *h2Stream) LocalAddr() net.Addr  { return s.local }
+func (s *h2Stream) RemoteAddr() net.Addr { return s.remote }
+
+func (s *h2Stream) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *h2Stream) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		s.readDeadline.Store(nil)
+	} else {
+		s.readDeadline.Store(&t)
+	}
+	return nil
+}
+
+// SetWriteDeadline is not supported; writes block until the server reads
+// them or the stream is closed.
+func (s *h2Stream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
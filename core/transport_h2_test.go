@@ -0,0 +1,68 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+func TestH2PoolSharesConnection(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var accepted atomic.Int32
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			accepted.Add(1)
+		}
+	}
+	// Closing the pool can cut the server's side of the handshake short.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	server := config.ServerConfig{Address: host, Port: portNum, TLS: true, AllowInsecure: true}
+
+	var pool h2Pool
+	conns := make([]*h2Conn, 8)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc, err := pool.get(context.Background(), Direct, server)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conns[i] = cc
+		}()
+	}
+	wg.Wait()
+	for _, cc := range conns {
+		if cc != conns[0] {
+			t.Fatal("concurrent streams got different connections")
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("server accepted %d connections, want 1", n)
+	}
+
+	pool.Close()
+	if !conns[0].State().Closed {
+		t.Error("connection still open after Close")
+	}
+	if _, err := pool.get(context.Background(), Direct, server); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("get after Close: %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+func init() {
+	registerTransport("httpupgrade", dialHTTPUpgrade)
+}
+
+// dialHTTPUpgrade sends a WebSocket-style upgrade request to server.Path and,
+// once the server switches protocols, uses the raw connection as the stream
+// without any WebSocket framing.
+func dialHTTPUpgrade(ctx context.Context, dialer Dialer, server config.ServerConfig, _ *h2Pool) (net.Conn, error) {
+	path := server.Path
+	if path == "" {
+		path = "/"
+	}
+	conn, err := dialSecure(ctx, dialer, server, []string{"http/1.1"})
+	if err != nil {
+		return nil, err
+	}
+
+	clearDeadline := handshakeDeadline(ctx, conn)
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Opaque: path},
+		Host:   serverHost(server),
+		Header: http.Header{
+			"Connection": {"Upgrade"},
+			"Upgrade":    {"websocket"},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send HTTP upgrade request: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read HTTP upgrade response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP upgrade failed: %s", resp.Status)
+	}
+	clearDeadline()
+	return newBufferedConn(conn, br), nil
+}
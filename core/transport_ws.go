@@ -0,0 +1,310 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// wsMaxFrameSize is the largest frame accepted from the server.
+	wsMaxFrameSize = 1 << 24
+)
+
+func init() {
+	registerTransport("ws", dialWebSocket)
+}
+
+// dialWebSocket opens a WebSocket to server.Path on server.Host. An "ed"
+// query parameter in the path enables early data: up to that many bytes of
+// the first write are sent base64-encoded in the Sec-WebSocket-Protocol
+// header of the handshake, saving a round trip.
+func dialWebSocket(ctx context.Context, dialer Dialer, server config.ServerConfig, _ *h2Pool) (net.Conn, error) {
+	path, earlyData, err := parseEarlyData(server.Path)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialSecure(ctx, dialer, server, []string{"http/1.1"})
+	if err != nil {
+		return nil, err
+	}
+	c := &wsConn{Conn: conn, host: serverHost(server), path: path, earlyData: earlyData}
+	if earlyData == 0 {
+		clearDeadline := handshakeDeadline(ctx, conn)
+		if _, err := c.handshake(nil); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		clearDeadline()
+	}
+	return c, nil
+}
+
+// parseEarlyData removes the "ed" parameter from a WebSocket path and
+// returns it as the maximum early data size.
+func parseEarlyData(path string) (string, int, error) {
+	if path == "" {
+		return "/", 0, nil
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid WebSocket path: %w", err)
+	}
+	q := u.Query()
+	ed := q.Get("ed")
+	if ed == "" {
+		return path, 0, nil
+	}
+	n, err := strconv.Atoi(ed)
+	if err != nil || n < 0 {
+		return "", 0, fmt.Errorf("invalid WebSocket early data size: %s", ed)
+	}
+	q.Del("ed")
+	u.RawQuery = q.Encode()
+	return u.RequestURI(), n, nil
+}
+
+// wsConn is a client WebSocket carrying a byte stream in binary messages.
+type wsConn struct {
+	net.Conn
+	host      string
+	path      string
+	earlyData int
+
+	hmu    sync.Mutex
+	hsDone bool
+	hsErr  error
+
+	br        *bufio.Reader
+	rmu       sync.Mutex
+	remaining int64 // unread payload bytes of the current frame
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	wmu sync.Mutex
+}
+
+// handshake sends the upgrade request, carrying early as early data, and
+// checks the server's response. Only the first call has any effect; it
+// reports whether early was sent.
+func (c *wsConn) handshake(early []byte) (bool, error) {
+	c.hmu.Lock()
+	defer c.hmu.Unlock()
+	if c.hsDone {
+		return false, c.hsErr
+	}
+	c.hsDone = true
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Opaque: c.path},
+		Host:   c.host,
+		Header: http.Header{
+			"Connection":            {"Upgrade"},
+			"Upgrade":               {"websocket"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if len(early) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", base64.RawURLEncoding.EncodeToString(early))
+	}
+	if c.hsErr = req.Write(c.Conn); c.hsErr != nil {
+		return false, c.hsErr
+	}
+	c.br = bufio.NewReader(c.Conn)
+	resp, err := http.ReadResponse(c.br, req)
+	if err != nil {
+		c.hsErr = fmt.Errorf("failed to read WebSocket handshake response: %w", err)
+		return false, c.hsErr
+	}
+	resp.Body.Close()
+	h := sha1.Sum([]byte(key + wsAcceptGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		c.hsErr = fmt.Errorf("WebSocket handshake failed: %s", resp.Status)
+	} else if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(h[:]) {
+		c.hsErr = fmt.Errorf("WebSocket handshake failed: invalid Sec-WebSocket-Accept")
+	}
+	return true, c.hsErr
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	if _, err := c.handshake(nil); err != nil {
+		return 0, err
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads the next frame header, handling control frames. It only
+// consumes input once a whole header is buffered, so a read deadline can
+// interrupt it at any point.
+func (c *wsConn) nextFrame() error {
+	hdr, err := c.br.Peek(2)
+	if err != nil {
+		return err
+	}
+	op := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	size := int64(hdr[1] & 0x7F)
+	n := 2
+	switch size {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if masked {
+		n += 4
+	}
+	if hdr, err = c.br.Peek(n); err != nil {
+		return err
+	}
+	switch size {
+	case 126:
+		size = int64(binary.BigEndian.Uint16(hdr[2:]))
+	case 127:
+		// This also rejects lengths of 2^63 and up, which are negative
+		// as an int64.
+		n := binary.BigEndian.Uint64(hdr[2:])
+		if n > wsMaxFrameSize {
+			return fmt.Errorf("WebSocket frame of %d bytes is too large", n)
+		}
+		size = int64(n)
+	}
+	c.masked = masked
+	if masked {
+		copy(c.mask[:], hdr[n-4:])
+	}
+	c.maskPos = 0
+
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.br.Discard(n)
+		c.remaining = size
+		return nil
+	case wsOpClose:
+		return io.EOF
+	case wsOpPing, wsOpPong:
+		if size > 125 {
+			return fmt.Errorf("invalid WebSocket control frame")
+		}
+		frame, err := c.br.Peek(n + int(size))
+		if err != nil {
+			return err
+		}
+		payload := append([]byte(nil), frame[n:]...)
+		c.br.Discard(len(frame))
+		c.unmask(payload)
+		if op == wsOpPing {
+			return c.writeFrame(wsOpPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unexpected WebSocket opcode %d", op)
+	}
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	early := b[:min(len(b), c.earlyData)]
+	sent, err := c.handshake(early)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	if sent {
+		n = len(early)
+		b = b[n:]
+	}
+	if len(b) == 0 {
+		return n, nil
+	}
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return n, err
+	}
+	return n + len(b), nil
+}
+
+// writeFrame writes a single masked frame, as clients must.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame before closing the connection.
+func (c *wsConn) Close() error {
+	c.hmu.Lock()
+	done := c.hsDone && c.hsErr == nil
+	c.hmu.Unlock()
+	if done {
+		c.writeFrame(wsOpClose, nil)
+	}
+	return c.Conn.Close()
+}
@@ -1,326 +1,187 @@
 package core
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
-	"os/exec"
+	"net/netip"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/amirhosseinghanipour/nekogo/config"
-	ss "github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/songgao/water"
-	"golang.org/x/net/proxy"
 )
 
-type Forwarder interface {
-	ForwardTCP(pkt []byte) error
-	ForwardUDP(pkt []byte) error
+// lanPrefixes are the private and link-local ranges, which are routed around
+// the TUN device unless routing is strict.
+var lanPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
 }
 
-type ShadowsocksForwarder struct {
-	Server config.ServerConfig
-	Cipher ss.Cipher
+// tunSettings are the name, addresses and MTU of the TUN device.
+type tunSettings struct {
+	name    string
+	prefix4 netip.Prefix
+	prefix6 netip.Prefix
+	mtu     int
 }
 
-func NewShadowsocksForwarder(server config.ServerConfig) (*ShadowsocksForwarder, error) {
-	cipher, err := ss.PickCipher(server.Method, nil, server.Password)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
-	}
-	return &ShadowsocksForwarder{Server: server, Cipher: cipher}, nil
-}
-
-// SOCKS5 Forwarder
-
-type Socks5Forwarder struct {
-	Server config.ServerConfig
+// tunRouting is the routing that setupTUN installs.
+type tunRouting struct {
+	autoRoute bool           // if false, setupTUN installs no routes at all
+	include   []netip.Prefix // routed into the device; all traffic if empty
+	exclude   []netip.Prefix // routed around the device
+	strict    bool           // only exclude and bypass are routed around the device
+	dnsServer string         // Windows: the DNS server of the device
+	dnsRoutes []netip.Addr   // DNS servers routed into the device even on the LAN
+	bypass    []netip.Addr   // server addresses routed around the device
+	ipv4Only  bool           // the device has no IPv6 address, so IPv6 is not routed
 }
 
-func NewSocks5Forwarder(server config.ServerConfig) (*Socks5Forwarder, error) {
-	return &Socks5Forwarder{Server: server}, nil
+// dropIPv6 leaves IPv6 out of r, for a device without an IPv6 address.
+func (r *tunRouting) dropIPv6() {
+	r.ipv4Only = true
+	r.exclude = slices.DeleteFunc(r.exclude, func(p netip.Prefix) bool { return p.Addr().Is6() })
+	is6 := func(addr netip.Addr) bool { return addr.Is6() }
+	r.dnsRoutes = slices.DeleteFunc(r.dnsRoutes, is6)
+	r.bypass = slices.DeleteFunc(r.bypass, is6)
 }
 
-func (s *Socks5Forwarder) ForwardTCP(pkt []byte) error {
-	if len(pkt) < 20 {
-		return fmt.Errorf("packet too short")
-	}
-	ihl := int(pkt[0]&0x0F) * 4
-	if len(pkt) < ihl+20 {
-		return fmt.Errorf("not enough data for TCP header")
-	}
-	dstIP := net.IP(pkt[16:20])
-	dstPort := binary.BigEndian.Uint16(pkt[ihl+2 : ihl+4])
-	log.Printf("TUN TCP -> %s:%d (SOCKS5)", dstIP, dstPort)
-
-	proxyAddr := fmt.Sprintf("%s:%d", s.Server.Address, s.Server.Port)
-	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
-	if err != nil {
-		return fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
-	}
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", dstIP.String(), dstPort))
-	if err != nil {
-		return fmt.Errorf("failed to dial via SOCKS5: %w", err)
+// newTUNOptions parses the device settings and routes of cfg. The LAN is
+// excluded from the device unless cfg asks for strict routing.
+func newTUNOptions(cfg config.TUNConfig) (tunSettings, tunRouting, error) {
+	dev := tunSettings{name: cfg.DeviceName(), mtu: cfg.DeviceMTU()}
+	var err error
+	if dev.prefix4, err = netip.ParsePrefix(cfg.IPv4Address()); err != nil {
+		return dev, tunRouting{}, fmt.Errorf("invalid TUN address: %w", err)
 	}
-	defer conn.Close()
-	ihlTCP := ihl + 20
-	if len(pkt) > ihlTCP {
-		payload := pkt[ihlTCP:]
-		n, err := conn.Write(payload)
-		if err != nil {
-			return fmt.Errorf("failed to write payload: %w", err)
+	if addr6 := cfg.IPv6Address(); addr6 != "" {
+		if dev.prefix6, err = netip.ParsePrefix(addr6); err != nil {
+			return dev, tunRouting{}, fmt.Errorf("invalid TUN address: %w", err)
 		}
-		AddBytesSent(int64(n))
 	}
-	return nil
-}
-
-func (s *Socks5Forwarder) ForwardUDP(pkt []byte) error {
-	if len(pkt) < 20 {
-		return fmt.Errorf("packet too short")
+	r := tunRouting{autoRoute: cfg.AutoRouteEnabled(), strict: cfg.StrictRoute}
+	if r.include, err = parsePrefixes(cfg.IncludeRoutes); err != nil {
+		return dev, r, fmt.Errorf("invalid TUN route: %w", err)
 	}
-	ihl := int(pkt[0]&0x0F) * 4
-	if len(pkt) < ihl+8 {
-		return fmt.Errorf("not enough data for UDP header")
+	if r.exclude, err = parsePrefixes(cfg.ExcludeRoutes); err != nil {
+		return dev, r, fmt.Errorf("invalid TUN route: %w", err)
 	}
-	dstIP := net.IP(pkt[16:20])
-	dstPort := binary.BigEndian.Uint16(pkt[ihl+2 : ihl+4])
-	log.Printf("TUN UDP -> %s:%d (SOCKS5)", dstIP, dstPort)
-
-	proxyAddr := fmt.Sprintf("%s:%d", s.Server.Address, s.Server.Port)
-	dialer, err := proxy.SOCKS5("tcp", proxyAddr, nil, proxy.Direct)
-	if err != nil {
-		return fmt.Errorf("failed to create SOCKS5 dialer for UDP associate: %w", err)
-	}
-	conn, err := dialer.Dial("tcp", proxyAddr) // Connect to the SOCKS server
-	if err != nil {
-		return fmt.Errorf("failed to dial SOCKS5 server for UDP associate: %w", err)
-	}
-	defer conn.Close()
-
-	// 1. Send UDP ASSOCIATE command
-	b := []byte{0x05, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	if _, err := conn.Write(b); err != nil {
-		return fmt.Errorf("failed to write UDP associate request: %w", err)
-	}
-
-	// 2. Read the server's reply
-	resp := make([]byte, 256)
-	n, err := conn.Read(resp)
-	if err != nil {
-		return fmt.Errorf("failed to read UDP associate reply: %w", err)
+	if !r.strict {
+		r.exclude = slices.Concat(lanPrefixes, r.exclude)
 	}
-	if n < 10 || resp[0] != 0x05 || resp[1] != 0x00 {
-		return fmt.Errorf("UDP associate failed, server response: %v", resp[:n])
-	}
-	bndPort := binary.BigEndian.Uint16(resp[n-2:])
-	bndAddr := net.IP(resp[4 : n-2])
-
-	// 3. Send the UDP datagram to the address we got from the server
-	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: bndAddr, Port: int(bndPort)})
-	if err != nil {
-		return fmt.Errorf("failed to dial UDP relay: %w", err)
-	}
-	defer udpConn.Close()
-
-	// 4. Construct the SOCKS5 UDP request packet
-	udpReq := []byte{0x00, 0x00, 0x00, 0x01} // RSV, FRAG, ATYP (IPv4)
-	udpReq = append(udpReq, dstIP.To4()...)
-	portBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(portBytes, dstPort)
-	udpReq = append(udpReq, portBytes...)
-	udpReq = append(udpReq, pkt[ihl+8:]...) // Append the original UDP payload
-
-	if _, err := udpConn.Write(udpReq); err != nil {
-		return fmt.Errorf("failed to write UDP packet to relay: %w", err)
-	}
-	AddBytesSent(int64(len(udpReq)))
-	return nil
+	return dev, r, nil
 }
 
-// HTTP Forwarder (CONNECT only, for HTTPS)
-type HttpForwarder struct {
-	Server config.ServerConfig
-}
-
-func NewHttpForwarder(server config.ServerConfig) (*HttpForwarder, error) {
-	return &HttpForwarder{Server: server}, nil
-}
-
-func (h *HttpForwarder) ForwardTCP(pkt []byte) error {
-	if len(pkt) < 20 {
-		return fmt.Errorf("packet too short")
-	}
-	ihl := int(pkt[0]&0x0F) * 4
-	if len(pkt) < ihl+20 {
-		return fmt.Errorf("not enough data for TCP header")
+func StartTUNWithConfig(cfg *config.AppConfig, stopChan <-chan struct{}) error {
+	if err := cfg.Validate(); err != nil {
+		return err
 	}
-	dstIP := net.IP(pkt[16:20])
-	dstPort := binary.BigEndian.Uint16(pkt[ihl+2 : ihl+4])
-	log.Printf("TUN TCP -> %s:%d (HTTP/HTTPS)", dstIP, dstPort)
-
-	proxyAddr := fmt.Sprintf("%s:%d", h.Server.Address, h.Server.Port)
-	conn, err := net.Dial("tcp", proxyAddr)
+	outbounds := NewOutbounds(cfg)
+	defer outbounds.Close()
+	active, err := outbounds.Active()
 	if err != nil {
-		return fmt.Errorf("failed to dial HTTP proxy: %w", err)
+		return err
 	}
-	defer conn.Close()
-	// Send CONNECT request
-	connectReq := fmt.Sprintf("CONNECT %s:%d HTTP/1.1\r\nHost: %s:%d\r\n\r\n", dstIP.String(), dstPort, dstIP.String(), dstPort)
-	if _, err := conn.Write([]byte(connectReq)); err != nil {
-		return fmt.Errorf("failed to send CONNECT: %w", err)
-	}
-	// Read response (very basic, not robust)
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+	dialer, err := NewRouter(cfg, outbounds, active)
 	if err != nil {
-		return fmt.Errorf("failed to read CONNECT response: %w", err)
-	}
-	if n < 12 || string(buf[:12]) != "HTTP/1.1 200" {
-		return fmt.Errorf("proxy CONNECT failed: %s", string(buf[:n]))
+		return err
 	}
-	ihlTCP := ihl + 20
-	if len(pkt) > ihlTCP {
-		payload := pkt[ihlTCP:]
-		n, err := conn.Write(payload)
-		if err != nil {
-			return fmt.Errorf("failed to write payload: %w", err)
+	setRunning(nil, outbounds)
+	defer setRunning(outbounds, nil)
+	setDirectDNS(nil, dialer.DNS())
+	defer setDirectDNS(dialer.DNS(), nil)
+
+	var fakeIP *FakeIPPool
+	if cfg.DNS.FakeIP.Enabled {
+		if fakeIP, err = NewFakeIPPool(cfg.DNS.FakeIP); err != nil {
+			return err
 		}
-		AddBytesSent(int64(n))
+		defer func() {
+			if err := fakeIP.Close(); err != nil {
+				log.Println(err)
+			}
+		}()
+		dialer.DNS().SetFakeIP(fakeIP)
 	}
-	return nil
-}
-
-func (h *HttpForwarder) ForwardUDP(pkt []byte) error {
-	log.Println("UDP forwarding is not supported by HTTP proxies.")
-	return nil
-}
 
-// WriteAddr writes the Shadowsocks address format
-func WriteAddr(conn net.Conn, ip net.IP, port uint16) error {
-	if ip.To4() != nil {
-		if _, err := conn.Write([]byte{0x01}); err != nil {
+	// Windows is pointed at the local DNS listener if there is one and no
+	// other server is configured.
+	systemDNS := "8.8.8.8"
+	if cfg.DNS.Listen != "" {
+		dnsServer, err := ListenDNS(dialer.DNS(), cfg.DNS.Listen)
+		if err != nil {
 			return err
 		}
-		if _, err := conn.Write(ip.To4()); err != nil {
-			return err
+		defer dnsServer.Close()
+		systemDNS, _, _ = net.SplitHostPort(cfg.DNS.Listen)
+		if ip := net.ParseIP(systemDNS); ip == nil || ip.IsUnspecified() {
+			systemDNS = "127.0.0.1"
 		}
-	} else {
-		return fmt.Errorf("unsupported address type")
 	}
-	portBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(portBytes, port)
-	_, err := conn.Write(portBytes)
-	return err
-}
 
-func (s *ShadowsocksForwarder) ForwardTCP(pkt []byte) error {
-	if len(pkt) < 20 {
-		return fmt.Errorf("packet too short")
+	// Routing left behind by a run that crashed would get in the way.
+	if err := recoverTUNRouting(); err != nil {
+		log.Printf("Failed to remove routing left by a previous run: %v", err)
 	}
-	ihl := int(pkt[0]&0x0F) * 4
-	if len(pkt) < ihl+20 {
-		return fmt.Errorf("not enough data for TCP header")
-	}
-	dstIP := net.IP(pkt[16:20])
-	dstPort := binary.BigEndian.Uint16(pkt[ihl+2 : ihl+4])
-	log.Printf("TUN TCP -> %s:%d", dstIP, dstPort)
-
-	ssAddr := fmt.Sprintf("%s:%d", s.Server.Address, s.Server.Port)
-	rawConn, err := net.Dial("tcp", ssAddr)
+	dev, routing, err := newTUNOptions(cfg.TUN)
 	if err != nil {
-		return fmt.Errorf("failed to dial Shadowsocks: %w", err)
+		return err
 	}
-	defer rawConn.Close()
-	conn := s.Cipher.StreamConn(rawConn)
-
-	if err := WriteAddr(conn, dstIP, dstPort); err != nil {
-		return fmt.Errorf("failed to write addr: %w", err)
+	routing.dnsServer = systemDNS
+	if cfg.TUN.DNS != "" {
+		routing.dnsServer = cfg.TUN.DNS
 	}
-	ihlTCP := ihl + 20
-	if len(pkt) > ihlTCP {
-		payload := pkt[ihlTCP:]
-		n, err := conn.Write(payload)
-		if err != nil {
-			return fmt.Errorf("failed to write payload: %w", err)
+	if routing.autoRoute {
+		routing.bypass = serverAddrs(cfg)
+		if cfg.DNS.Strict {
+			routing.dnsRoutes = systemResolvers()
 		}
-		AddBytesSent(int64(n))
-	}
-	return nil
-}
-
-func (s *ShadowsocksForwarder) ForwardUDP(pkt []byte) error {
-	if len(pkt) < 20 {
-		return fmt.Errorf("packet too short")
 	}
-	ihl := int(pkt[0]&0x0F) * 4
-	if len(pkt) < ihl+8 {
-		return fmt.Errorf("not enough data for UDP header")
+	if !dev.prefix6.IsValid() {
+		routing.dropIPv6()
 	}
-	dstIP := net.IP(pkt[16:20])
-	dstPort := binary.BigEndian.Uint16(pkt[ihl+2 : ihl+4])
-	log.Printf("TUN UDP -> %s:%d", dstIP, dstPort)
-
-	ssAddr := fmt.Sprintf("%s:%d", s.Server.Address, s.Server.Port)
-	c, err := net.Dial("udp", ssAddr)
+	ifce, teardown, err := setupTUN(dev, routing)
 	if err != nil {
-		return fmt.Errorf("failed to dial UDP for Shadowsocks: %w", err)
-	}
-	defer c.Close()
-
-	pc, ok := c.(net.PacketConn)
-	if !ok {
-		return fmt.Errorf("connection does not implement net.PacketConn")
-	}
-	pc = s.Cipher.PacketConn(pc)
-
-	tgt := &net.UDPAddr{IP: dstIP, Port: int(dstPort)}
-	payload := pkt[ihl+8:]
-	_, err = pc.WriteTo(payload, tgt)
-	if err != nil {
-		return fmt.Errorf("failed to write payload to SS UDP: %w", err)
-	}
-	AddBytesSent(int64(len(payload)))
-	return nil
-}
-
-func StartTUNWithConfig(cfg *config.AppConfig, stopChan <-chan struct{}) error {
-	if err := cfg.Validate(); err != nil {
 		return err
 	}
-	active := cfg.Servers[cfg.ActiveIndex]
-	var forwarder Forwarder
-	var err error
+	defer ifce.Close()
+	defer teardown()
+	log.Printf("TUN interface created: %s", ifce.Name())
 
-	switch active.Type {
-	case "shadowsocks":
-		forwarder, err = NewShadowsocksForwarder(active)
-	case "socks5":
-		forwarder, err = NewSocks5Forwarder(active)
-	// VLESS, VMess, and Trojan require a full V2Ray-core implementation, which is a very large project.
-	// This TUN implementation will forward standard protocols through Shadowsocks/SOCKS5.
-	default:
-		return fmt.Errorf("unsupported server type for TUN mode: %s", active.Type)
-	}
+	hijack := newDNSHijack(ifce, cfg.DNS, dialer.DNS())
+	netStack, err := NewNetStack(ifce, uint32(dev.mtu), func(conn net.Conn, dst *net.TCPAddr) {
+		if hijack != nil && hijack.HandleConn(conn, dst) {
+			return
+		}
+		handleTCPConn(dialer, conn, dst, cfg.Sniff, fakeIP)
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to start userspace network stack: %w", err)
 	}
+	defer netStack.Close()
 
-	ifce, err := setupTUN()
-	if err != nil {
-		return err
-	}
-	defer ifce.Close()
-	log.Printf("TUN interface created: %s", ifce.Name())
+	udpNat := NewUDPNat(ifce, dialer, cfg.Sniff, fakeIP)
+	defer udpNat.Close()
 
 	packetChan := make(chan []byte, 100)
-	for i := 0; i < 10; i++ {
-		go packetWorker(ifce, forwarder, packetChan)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go packetWorker(ifce, netStack, udpNat, hijack, packetChan)
 	}
 
 	go func() {
-		buf := make([]byte, 1500)
+		defer close(packetChan)
+		buf := make([]byte, dev.mtu)
 		for {
 			select {
 			case <-stopChan:
@@ -342,45 +203,83 @@ func StartTUNWithConfig(cfg *config.AppConfig, stopChan <-chan struct{}) error {
 	return nil
 }
 
-
-func packetWorker(ifce TUNDevice, forwarder Forwarder, packetChan <-chan []byte) {
+func packetWorker(ifce TUNDevice, netStack *NetStack, udpNat *UDPNat, hijack *dnsHijack, packetChan <-chan []byte) {
 	for packet := range packetChan {
-		AddBytesReceived(int64(len(packet)))
-		if len(packet) < 20 {
+		hdr, err := parseIPHeader(packet)
+		if err != nil {
 			continue // Not a valid IP packet
 		}
-		proto := packet[9] // IPv4 protocol field
-		switch proto {
-		case 1: // ICMP
-			handleICMP(ifce, packet)
-		case 6: // TCP
-			if err := forwarder.ForwardTCP(packet); err != nil {
-				log.Printf("TCP forwarding error: %v", err)
+		switch hdr.Protocol {
+		case protoICMP:
+			if hdr.Version == 4 {
+				handleICMP(ifce, packet, hdr)
+			}
+		case protoICMPv6:
+			handleICMPv6(ifce, packet, hdr)
+		case protoTCP:
+			netStack.InjectPacket(packet)
+		case protoUDP:
+			if hijack != nil && hijack.HandlePacket(packet) {
+				continue
 			}
-		case 17: // UDP
-			if err := forwarder.ForwardUDP(packet); err != nil {
+			if err := udpNat.HandlePacket(packet); err != nil {
 				log.Printf("UDP forwarding error: %v", err)
 			}
 		}
 	}
 }
 
-func handleICMP(ifce TUNDevice, pkt []byte) {
-	if len(pkt) < 28 {
+// handleTCPConn dials the destination of a TCP flow accepted by the userspace
+// stack and relays it until either side closes. Fake IPs from fakeIP, if
+// set, are dialed by their domain names.
+func handleTCPConn(dialer Dialer, conn net.Conn, dst *net.TCPAddr, sniff config.SniffConfig, fakeIP *FakeIPPool) {
+	defer conn.Close()
+	ctx := withSource(context.Background(), conn.RemoteAddr().String())
+	target, err := fakeIP.target(dst.AddrPort())
+	if err != nil {
+		log.Printf("TUN TCP -> %s: %v", dst, err)
 		return
 	}
-	if pkt[20] == 8 && pkt[21] == 0 {
+	var res sniffResult
+	if sniff.Enabled {
+		conn, res = sniffTCP(conn)
+		ctx = withSniffed(ctx, res)
+		if sniff.Override && res.Domain != "" {
+			target = net.JoinHostPort(res.Domain, strconv.Itoa(dst.Port))
+		}
+	}
+	if res.Protocol != "" {
+		log.Printf("TUN TCP -> %s (%s %s)", dst, res.Protocol, res.Domain)
+	} else {
+		log.Printf("TUN TCP -> %s", dst)
+	}
+	upstream, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		log.Printf("TCP forwarding error: %v", err)
+		return
+	}
+	defer upstream.Close()
+	relay(conn, upstream)
+}
+
+func handleICMP(ifce TUNDevice, pkt []byte, hdr *ipHeader) {
+	icmp := pkt[hdr.Offset:hdr.Length]
+	if len(icmp) < 8 || hdr.Fragment {
+		return
+	}
+	if icmp[0] == 8 && icmp[1] == 0 {
 		log.Println("TUN ICMP -> Echo Request received (Ping)")
-		replyPkt := make([]byte, len(pkt))
+		replyPkt := make([]byte, hdr.Length)
 		copy(replyPkt, pkt)
 
 		copy(replyPkt[12:16], pkt[16:20])
 		copy(replyPkt[16:20], pkt[12:16])
-		replyPkt[20] = 0
-		replyPkt[10] = 0
-		replyPkt[22] = 0
-		binary.BigEndian.PutUint16(replyPkt[22:], checksum(replyPkt[20:]))
-		binary.BigEndian.PutUint16(replyPkt[10:], checksum(replyPkt[:20]))
+		replyICMP := replyPkt[hdr.Offset:]
+		replyICMP[0] = 0
+		binary.BigEndian.PutUint16(replyICMP[2:], 0)
+		binary.BigEndian.PutUint16(replyICMP[2:], checksum(replyICMP))
+		binary.BigEndian.PutUint16(replyPkt[10:], 0)
+		binary.BigEndian.PutUint16(replyPkt[10:], checksum(replyPkt[:hdr.Offset]))
 
 		if _, err := ifce.Write(replyPkt); err != nil {
 			log.Printf("Failed to write ICMP echo reply: %v", err)
@@ -390,13 +289,40 @@ func handleICMP(ifce TUNDevice, pkt []byte) {
 	}
 }
 
+// handleICMPv6 answers echo requests, mirroring handleICMP for IPv6.
+func handleICMPv6(ifce TUNDevice, pkt []byte, hdr *ipHeader) {
+	icmp := pkt[hdr.Offset:hdr.Length]
+	if len(icmp) < 8 || hdr.Fragment {
+		return
+	}
+	if icmp[0] == 128 && icmp[1] == 0 {
+		log.Println("TUN ICMPv6 -> Echo Request received (Ping)")
+		// The reply is sent without the request's extension headers.
+		replyPkt, err := buildIPHeader(hdr.Dst, hdr.Src, protoICMPv6, len(icmp))
+		if err != nil {
+			return
+		}
+		replyPkt = append(replyPkt, icmp...)
+		replyICMP := replyPkt[ipv6HeaderLen:]
+		replyICMP[0] = 129
+		binary.BigEndian.PutUint16(replyICMP[2:], 0)
+		binary.BigEndian.PutUint16(replyICMP[2:], transportChecksum(hdr.Dst, hdr.Src, protoICMPv6, replyICMP))
+
+		if _, err := ifce.Write(replyPkt); err != nil {
+			log.Printf("Failed to write ICMPv6 echo reply: %v", err)
+		} else {
+			AddBytesSent(int64(len(replyPkt)))
+		}
+	}
+}
+
 func checksum(data []byte) uint16 {
 	var sum uint32
 	for i := 0; i+1 < len(data); i += 2 {
 		sum += uint32(binary.BigEndian.Uint16(data[i:]))
 	}
 	if len(data)%2 == 1 {
-		sum += uint32(data[len(data)-1])
+		sum += uint32(data[len(data)-1]) << 8
 	}
 	for sum>>16 > 0 {
 		sum = (sum & 0xffff) + (sum >> 16)
@@ -404,39 +330,57 @@ func checksum(data []byte) uint16 {
 	return uint16(^sum)
 }
 
-func setupTUN() (TUNDevice, error) {
+// serverAddrs returns the addresses of the configured servers. Domain names
+// are looked up with the system resolver, before TUN mode routes DNS.
+func serverAddrs(cfg *config.AppConfig) []netip.Addr {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		addrs []netip.Addr
+		seen  = make(map[string]bool)
+	)
+	for _, s := range cfg.Servers {
+		if seen[s.Address] {
+			continue
+		}
+		seen[s.Address] = true
+		if addr, err := netip.ParseAddr(s.Address); err == nil {
+			addrs = append(addrs, addr.Unmap())
+			continue
+		}
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+			defer cancel()
+			resolved, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+			if err != nil {
+				log.Printf("Failed to resolve server %s, it is not routed around TUN: %v", host, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, addr := range resolved {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}(s.Address)
+	}
+	wg.Wait()
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	return slices.Compact(addrs)
+}
+
+// newTUNDevice creates the TUN device, which has no addresses or routes
+// yet. macOS picks the name itself unless name is of the form utunN.
+func newTUNDevice(name string) (*water.Interface, error) {
 	cfg := water.Config{DeviceType: water.TUN}
-	cfg.Name = "nekogo-tun"
+	if runtime.GOOS != "darwin" || strings.HasPrefix(name, "utun") {
+		cfg.Name = name
+	}
 	ifce, err := water.New(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create TUN interface: %w", err)
 	}
-	switch runtime.GOOS {
-	case "linux":
-		if err := exec.Command("sudo", "ip", "addr", "add", "10.0.85.2/24", "dev", ifce.Name()).Run(); err != nil {
-			log.Printf("Error setting IP address: %v", err)
-		}
-		if err := exec.Command("sudo", "ip", "link", "set", "dev", ifce.Name(), "up").Run(); err != nil {
-			log.Printf("Error bringing up interface: %v", err)
-		}
-		if err := exec.Command("sudo", "ip", "route", "add", "default", "dev", ifce.Name()).Run(); err != nil {
-			log.Printf("Error setting default route: %v", err)
-		}
-	case "darwin":
-		if err := exec.Command("sudo", "ifconfig", ifce.Name(), "10.0.85.2", "10.0.85.1", "up").Run(); err != nil {
-			return nil, fmt.Errorf("failed to setup TUN interface on macOS: %w", err)
-		}
-		if err := exec.Command("sudo", "route", "add", "default", "10.0.85.1").Run(); err != nil {
-			return nil, fmt.Errorf("failed to set default route on macOS: %w", err)
-		}
-	case "windows":
-		if err := exec.Command("netsh", "interface", "ip", "set", "address", fmt.Sprintf("name=\"%s\"", ifce.Name()), "static", "10.0.85.2", "255.255.255.0").Run(); err != nil {
-			return nil, fmt.Errorf("failed to setup TUN interface on Windows: %w", err)
-		}
-		if err := exec.Command("netsh", "interface", "ip", "set", "dns", fmt.Sprintf("name=\"%s\"", ifce.Name()), "static", "8.8.8.8").Run(); err != nil {
-			log.Printf("Could not set DNS on Windows, this is not a fatal error: %v", err)
-		}
-	}
 	return ifce, nil
 }
 
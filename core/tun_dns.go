@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+const (
+	// dnsPort is the port of the DNS queries that TUN mode answers itself.
+	dnsPort = 53
+	// dotPort is the port of DNS over TLS and DNS over QUIC.
+	dotPort = 853
+)
+
+// dnsHijack answers DNS queries that arrive on the TUN device with NekoGo's
+// DNS, whatever server they were sent to, and refuses encrypted DNS on
+// port 853 if asked to.
+type dnsHijack struct {
+	ifce TUNDevice
+	dns  *DNS // nil if port 53 is not hijacked
+	dot  bool // refuse port 853
+}
+
+// newDNSHijack returns the hijacker that cfg asks for, or nil if DNS on the
+// TUN device is to be forwarded like other traffic.
+func newDNSHijack(ifce TUNDevice, cfg config.DNSConfig, dns *DNS) *dnsHijack {
+	h := &dnsHijack{ifce: ifce, dot: cfg.HijackDoT || cfg.Strict}
+	if cfg.HijacksTUN() {
+		h.dns = dns
+	}
+	if h.dns == nil && !h.dot {
+		return nil
+	}
+	return h
+}
+
+// HandlePacket answers pkt if it is a DNS query over UDP, drops it if it is
+// refused DNS over QUIC, and reports whether it was either.
+func (h *dnsHijack) HandlePacket(pkt []byte) bool {
+	p, err := parseUDPPacket(pkt)
+	if err != nil {
+		return false
+	}
+	switch {
+	case p.Dst.Port() == dnsPort && h.dns != nil:
+	case p.Dst.Port() == dotPort && h.dot:
+		return true
+	default:
+		return false
+	}
+	go func() {
+		resp := h.dns.handle(context.Background(), p.Payload, dnsUDPSize(p.Payload))
+		if resp == nil {
+			return
+		}
+		// The reply comes from the server the query was sent to.
+		reply, err := buildUDPPacket(p.Dst, p.Src, resp)
+		if err != nil {
+			log.Printf("Failed to build DNS reply: %v", err)
+			return
+		}
+		if _, err := h.ifce.Write(reply); err != nil {
+			log.Printf("Failed to write DNS reply to TUN: %v", err)
+		}
+	}()
+	return true
+}
+
+// HandleConn answers the queries on conn if it is DNS over TCP, closes it
+// if it is refused DNS over TLS, and reports whether it was either.
+func (h *dnsHijack) HandleConn(conn net.Conn, dst *net.TCPAddr) bool {
+	switch {
+	case dst.Port == dnsPort && h.dns != nil:
+		defer conn.Close()
+		serveDNSStream(h.dns, conn)
+		return true
+	case dst.Port == dotPort && h.dot:
+		conn.Close()
+		return true
+	}
+	return false
+}
+
+// resolvConfFiles list the system's DNS servers. On systems running
+// systemd-resolved, the first only names its local stub, and the second
+// the servers it forwards to.
+var resolvConfFiles = []string{"/etc/resolv.conf", "/run/systemd/resolve/resolv.conf"}
+
+// systemResolvers returns the non-loopback DNS servers the system is
+// configured with, which strict mode routes into the TUN device so that
+// queries to them cannot leave through a more specific route, such as that
+// of the LAN.
+func systemResolvers() []netip.Addr {
+	var addrs []netip.Addr
+	seen := make(map[netip.Addr]bool)
+	for _, path := range resolvConfFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			addr, err := netip.ParseAddr(fields[1])
+			if err != nil || addr.Zone() != "" || addr.IsLoopback() || seen[addr.Unmap()] {
+				continue
+			}
+			seen[addr.Unmap()] = true
+			addrs = append(addrs, addr.Unmap())
+		}
+		f.Close()
+	}
+	return addrs
+}
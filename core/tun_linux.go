@@ -0,0 +1,122 @@
+package core
+
+import (
+	"log"
+	"net/netip"
+	"slices"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// tunRouteTable is the routing table of the routes through the TUN
+	// device.
+	tunRouteTable = 2022
+
+	// The policy rules of TUN mode have these priorities, before the main
+	// table's at 32766:
+	tunRuleBypass   = 9000 // marked sockets and server addresses use the main table
+	tunRuleDNS      = 9001 // DNS servers routed into the TUN device by strict mode
+	tunRuleExclude  = 9002 // excluded routes and, unless strict, LAN ranges use the main table
+	tunRuleMain     = 9003 // unless strict, main table routes other than default routes
+	tunRuleFallback = 9004 // everything else goes into the TUN device
+)
+
+// defaultRoutes are the IPv4 and IPv6 default routes.
+var defaultRoutes = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+
+// setupTUN creates the TUN device and routes traffic through it. The routes
+// are kept in a table of their own that policy rules consult once the main
+// table has found no route more specific than its default route, so the
+// main table is left as it was. The returned function removes the rules
+// again; the routes go away with the device.
+func setupTUN(dev tunSettings, r tunRouting) (TUNDevice, func(), error) {
+	ifce, err := newTUNDevice(dev.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := newLinuxNet()
+	if err != nil {
+		ifce.Close()
+		return nil, nil, err
+	}
+	defer n.Close()
+	addrs := []netip.Prefix{dev.prefix4}
+	if dev.prefix6.IsValid() {
+		addrs = append(addrs, dev.prefix6)
+	}
+	if err := n.configureLink(ifce.Name(), addrs, dev.mtu); err != nil {
+		ifce.Close()
+		return nil, nil, err
+	}
+	if !r.autoRoute {
+		return ifce, func() {}, nil
+	}
+	if err := configureTUNRoutes(n, ifce.Name(), r); err != nil {
+		n.deleteRules(tunRuleBypass, tunRuleFallback)
+		ifce.Close()
+		return nil, nil, err
+	}
+	socketMark.Store(tunBypassMark)
+	return ifce, func() {
+		socketMark.Store(0)
+		if err := recoverTUNRouting(); err != nil {
+			log.Printf("Failed to remove TUN routing: %v", err)
+		}
+	}, nil
+}
+
+// configureTUNRoutes sets up the routes and rules through the TUN device
+// name in the namespace of n.
+func configureTUNRoutes(n *linuxNet, name string, r tunRouting) error {
+	families := []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+	routes := slices.Clone(r.include)
+	if len(routes) == 0 {
+		routes = slices.Clone(defaultRoutes)
+	}
+	if r.ipv4Only {
+		families = families[:1]
+		routes = slices.DeleteFunc(routes, func(p netip.Prefix) bool { return p.Addr().Is6() })
+	}
+	var rules []*netlink.Rule
+	for _, family := range families {
+		marked := newRule(tunRuleBypass, unix.RT_TABLE_MAIN, family, netip.Prefix{})
+		marked.Mark = tunBypassMark
+		rules = append(rules, marked)
+	}
+	for _, addr := range r.bypass {
+		rules = append(rules, newRule(tunRuleBypass, unix.RT_TABLE_MAIN, 0, netip.PrefixFrom(addr, addr.BitLen())))
+	}
+	for _, addr := range r.dnsRoutes {
+		dst := netip.PrefixFrom(addr, addr.BitLen())
+		routes = append(routes, dst)
+		rules = append(rules, newRule(tunRuleDNS, tunRouteTable, 0, dst))
+	}
+	for _, p := range r.exclude {
+		rules = append(rules, newRule(tunRuleExclude, unix.RT_TABLE_MAIN, 0, p))
+	}
+	if err := n.addRoutes(name, routes, tunRouteTable); err != nil {
+		return err
+	}
+	for _, family := range families {
+		if !r.strict {
+			main := newRule(tunRuleMain, unix.RT_TABLE_MAIN, family, netip.Prefix{})
+			main.SuppressPrefixlen = 0
+			rules = append(rules, main)
+		}
+		rules = append(rules, newRule(tunRuleFallback, tunRouteTable, family, netip.Prefix{}))
+	}
+	return n.replaceRules(tunRuleBypass, tunRuleFallback, rules)
+}
+
+// recoverTUNRouting removes the policy rules of TUN mode, which outlive
+// the device if NekoGo exits without tearing them down.
+func recoverTUNRouting() error {
+	n, err := newLinuxNet()
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+	return n.deleteRules(tunRuleBypass, tunRuleFallback)
+}
@@ -0,0 +1,336 @@
+//go:build !linux
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// splitDefaultRoutes together cover all addresses. Routes to them take
+// precedence over the default route without replacing it.
+var splitDefaultRoutes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/1"),
+	netip.MustParsePrefix("128.0.0.0/1"),
+	netip.MustParsePrefix("::/1"),
+	netip.MustParsePrefix("8000::/1"),
+}
+
+// osRoute is a route added with the system's tools, through a gateway or
+// through an interface.
+type osRoute struct {
+	Dst     netip.Prefix `json:"dst"`
+	Gateway netip.Addr   `json:"gateway,omitzero"`
+	Iface   string       `json:"iface,omitempty"`
+	Index   int          `json:"index,omitempty"` // interface of the gateway
+
+	required bool // setup fails if the route cannot be added
+}
+
+// routeJournalPath is the file that lists the routes TUN mode has added,
+// so that they can be removed after a crash.
+var routeJournalPath = filepath.Join(os.TempDir(), "nekogo-routes.json")
+
+// setupTUN creates the TUN device and routes traffic through it, as well
+// as the DNS servers in r.dnsRoutes even where more specific routes exist.
+// Server addresses and excluded ranges are routed through the original
+// default gateway of their family, and the sockets Direct opens are bound
+// to its interface. On Windows, the device's DNS server is set to
+// r.dnsServer. The returned function removes the routes again.
+func setupTUN(dev tunSettings, r tunRouting) (TUNDevice, func(), error) {
+	// The gateways must be looked up before the device takes over.
+	var gw4, gw6 defaultRoute
+	err4 := errors.New("routing is off")
+	err6 := err4
+	if r.autoRoute {
+		gw4, err4 = defaultGateway(false)
+		if r.ipv4Only {
+			err6 = errors.New("IPv6 is off")
+		} else {
+			gw6, err6 = defaultGateway(true)
+		}
+	}
+	ifce, err := newTUNDevice(dev.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := configureTUNDevice(ifce.Name(), dev, r.dnsServer); err != nil {
+		ifce.Close()
+		return nil, nil, err
+	}
+	if !r.autoRoute {
+		return ifce, func() {}, nil
+	}
+
+	var routes []osRoute
+	for _, gw := range []struct {
+		route defaultRoute
+		err   error
+		is4   bool
+	}{{gw4, err4, true}, {gw6, err6, false}} {
+		if gw.err != nil {
+			if !gw.is4 && r.ipv4Only {
+				continue
+			}
+			log.Printf("Servers and excluded routes are not routed around TUN: %v", gw.err)
+			continue
+		}
+		for _, addr := range r.bypass {
+			if addr.Is4() == gw.is4 {
+				routes = append(routes, osRoute{Dst: netip.PrefixFrom(addr, addr.BitLen()), Gateway: gw.route.gateway, Index: gw.route.index, required: true})
+			}
+		}
+		for _, p := range r.exclude {
+			if p.Addr().Is4() == gw.is4 {
+				routes = append(routes, osRoute{Dst: p, Gateway: gw.route.gateway, Index: gw.route.index})
+			}
+		}
+	}
+	include := splitDefaultRoutes
+	if r.ipv4Only {
+		include = splitDefaultRoutes[:2]
+	}
+	if len(r.include) > 0 {
+		include = nil
+		for _, p := range r.include {
+			include = append(include, splitDefault(p)...)
+		}
+	}
+	for _, p := range include {
+		routes = append(routes, osRoute{Dst: p, Iface: ifce.Name()})
+	}
+	for _, addr := range r.dnsRoutes {
+		routes = append(routes, osRoute{Dst: netip.PrefixFrom(addr, addr.BitLen()), Iface: ifce.Name()})
+	}
+
+	var added []osRoute
+	for _, route := range routes {
+		if err := addOSRoute(route); err != nil {
+			// Without the routes around it, traffic to the servers would
+			// loop into the device.
+			if route.required {
+				removeOSRoutes(added)
+				os.Remove(routeJournalPath)
+				ifce.Close()
+				return nil, nil, err
+			}
+			log.Println(err)
+			continue
+		}
+		added = append(added, route)
+		if err := writeRouteJournal(added); err != nil {
+			log.Printf("Failed to record TUN routes: %v", err)
+		}
+	}
+	switch {
+	case err4 == nil:
+		boundInterface.Store(int32(gw4.index))
+	case err6 == nil:
+		boundInterface.Store(int32(gw6.index))
+	}
+	return ifce, func() {
+		boundInterface.Store(0)
+		if err := recoverTUNRouting(); err != nil {
+			log.Printf("Failed to remove TUN routing: %v", err)
+		}
+	}, nil
+}
+
+// configureTUNDevice sets the addresses and MTU of the TUN device name, and
+// on Windows its DNS server.
+func configureTUNDevice(name string, dev tunSettings, dnsServer string) error {
+	addr4 := dev.prefix4.Addr().String()
+	mtu := strconv.Itoa(dev.mtu)
+	switch runtime.GOOS {
+	case "darwin":
+		// utun devices are point-to-point; the peer is the first address of
+		// the network.
+		peer := dev.prefix4.Masked().Addr().Next()
+		if peer == dev.prefix4.Addr() {
+			peer = peer.Next()
+		}
+		if err := exec.Command("sudo", "ifconfig", name, addr4, peer.String(), "mtu", mtu, "up").Run(); err != nil {
+			return fmt.Errorf("failed to setup TUN interface on macOS: %w", err)
+		}
+		if !dev.prefix6.IsValid() {
+			break
+		}
+		if err := exec.Command("sudo", "ifconfig", name, "inet6", dev.prefix6.Addr().String(), "prefixlen", strconv.Itoa(dev.prefix6.Bits())).Run(); err != nil {
+			log.Printf("Error setting IPv6 address on macOS: %v", err)
+		}
+	case "windows":
+		mask := net.IP(net.CIDRMask(dev.prefix4.Bits(), 32)).String()
+		if err := exec.Command("netsh", "interface", "ip", "set", "address", fmt.Sprintf("name=\"%s\"", name), "static", addr4, mask).Run(); err != nil {
+			return fmt.Errorf("failed to setup TUN interface on Windows: %w", err)
+		}
+		if dev.prefix6.IsValid() {
+			if err := exec.Command("netsh", "interface", "ipv6", "add", "address", fmt.Sprintf("interface=\"%s\"", name), dev.prefix6.String()).Run(); err != nil {
+				log.Printf("Error setting IPv6 address on Windows: %v", err)
+			}
+		}
+		if err := exec.Command("netsh", "interface", "ipv4", "set", "subinterface", fmt.Sprintf("\"%s\"", name), "mtu="+mtu, "store=active").Run(); err != nil {
+			log.Printf("Error setting MTU on Windows: %v", err)
+		}
+		if err := exec.Command("netsh", "interface", "ip", "set", "dns", fmt.Sprintf("name=\"%s\"", name), "static", dnsServer).Run(); err != nil {
+			log.Printf("Could not set DNS on Windows, this is not a fatal error: %v", err)
+		}
+	}
+	return nil
+}
+
+// splitDefault returns the halves of p if it is a default route, which
+// would otherwise replace the system's, or p itself.
+func splitDefault(p netip.Prefix) []netip.Prefix {
+	if p.Bits() != 0 {
+		return []netip.Prefix{p}
+	}
+	if p.Addr().Is4() {
+		return splitDefaultRoutes[:2]
+	}
+	return splitDefaultRoutes[2:]
+}
+
+// defaultRoute is the next hop and outgoing interface of a default route.
+type defaultRoute struct {
+	gateway netip.Addr
+	index   int
+}
+
+// defaultGateway returns the IPv4 or IPv6 default route.
+func defaultGateway(ipv6 bool) (defaultRoute, error) {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	var gateway, iface string
+	switch runtime.GOOS {
+	case "darwin":
+		args := []string{"-n", "get", "default"}
+		if ipv6 {
+			args = []string{"-n", "get", "-inet6", "default"}
+		}
+		out, err := exec.Command("route", args...).Output()
+		if err != nil {
+			return defaultRoute{}, fmt.Errorf("failed to find the %s default gateway: %w", family, err)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			key, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+			switch key {
+			case "gateway":
+				gateway = strings.TrimSpace(value)
+			case "interface":
+				iface = strings.TrimSpace(value)
+			}
+		}
+		if i, err := net.InterfaceByName(iface); err == nil {
+			iface = strconv.Itoa(i.Index)
+		}
+	case "windows":
+		prefix := "0.0.0.0/0"
+		if ipv6 {
+			prefix = "::/0"
+		}
+		out, err := exec.Command("powershell", "-NoProfile", "-Command",
+			fmt.Sprintf("$r = Get-NetRoute -DestinationPrefix %s | Sort-Object RouteMetric | Select-Object -First 1; \"$($r.NextHop) $($r.ifIndex)\"", prefix)).Output()
+		if err != nil {
+			return defaultRoute{}, fmt.Errorf("failed to find the %s default gateway: %w", family, err)
+		}
+		gateway, iface, _ = strings.Cut(strings.TrimSpace(string(out)), " ")
+	default:
+		return defaultRoute{}, fmt.Errorf("finding the default gateway is not supported on %s", runtime.GOOS)
+	}
+	addr, err := netip.ParseAddr(gateway)
+	if err != nil || addr.Is4() == ipv6 {
+		return defaultRoute{}, fmt.Errorf("failed to find the default gateway: no %s default route", family)
+	}
+	index, err := strconv.Atoi(iface)
+	if err != nil || index <= 0 {
+		return defaultRoute{}, fmt.Errorf("failed to find the interface of the %s default route", family)
+	}
+	return defaultRoute{gateway: addr, index: index}, nil
+}
+
+func addOSRoute(r osRoute) error {
+	if err := routeCommand("add", r).Run(); err != nil {
+		return fmt.Errorf("failed to add route to %s: %w", r.Dst, err)
+	}
+	return nil
+}
+
+// routeCommand returns the command that adds or deletes r.
+func routeCommand(op string, r osRoute) *exec.Cmd {
+	family := "-inet"
+	if r.Dst.Addr().Is6() {
+		family = "-inet6"
+	}
+	switch {
+	case runtime.GOOS == "windows" && r.Gateway.Is6():
+		prefix := fmt.Sprintf("prefix=%s", r.Dst)
+		return exec.Command("netsh", "interface", "ipv6", op, "route", prefix, fmt.Sprintf("interface=%d", r.Index), "nexthop="+r.Gateway.String())
+	case runtime.GOOS == "windows" && r.Gateway.IsValid():
+		mask := net.IP(net.CIDRMask(r.Dst.Bits(), 32)).String()
+		return exec.Command("route", op, r.Dst.Addr().String(), "mask", mask, r.Gateway.String())
+	case runtime.GOOS == "windows":
+		family = "ipv4"
+		if r.Dst.Addr().Is6() {
+			family = "ipv6"
+		}
+		if op == "delete" {
+			return exec.Command("netsh", "interface", family, "delete", "route", r.Dst.String(), fmt.Sprintf("interface=\"%s\"", r.Iface))
+		}
+		return exec.Command("netsh", "interface", family, "add", "route", r.Dst.String(), fmt.Sprintf("interface=\"%s\"", r.Iface))
+	case r.Gateway.IsValid():
+		return exec.Command("sudo", "route", "-n", op, family, "-net", r.Dst.String(), r.Gateway.String())
+	default:
+		return exec.Command("sudo", "route", "-n", op, family, "-net", r.Dst.String(), "-interface", r.Iface)
+	}
+}
+
+// removeOSRoutes deletes routes, returning the first error.
+func removeOSRoutes(routes []osRoute) error {
+	var first error
+	for _, r := range routes {
+		if err := routeCommand("delete", r).Run(); err != nil && first == nil {
+			first = fmt.Errorf("failed to delete route to %s: %w", r.Dst, err)
+		}
+	}
+	return first
+}
+
+func writeRouteJournal(routes []osRoute) error {
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(routeJournalPath, data, 0o600)
+}
+
+// recoverTUNRouting removes the routes listed in the route journal, which
+// are left behind if NekoGo exits without tearing them down.
+func recoverTUNRouting() error {
+	data, err := os.ReadFile(routeJournalPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var routes []osRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		os.Remove(routeJournalPath)
+		return fmt.Errorf("invalid route journal: %w", err)
+	}
+	err = removeOSRoutes(routes)
+	os.Remove(routeJournalPath)
+	return err
+}
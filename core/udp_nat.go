@@ -0,0 +1,261 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+const (
+	// udpSessionTimeout is how long a UDP session may stay idle before its
+	// upstream socket is released.
+	udpSessionTimeout = 60 * time.Second
+
+	udpBufSize = 64 * 1024
+
+	// udpPendingPackets is how many datagrams of a new session are queued
+	// while its upstream is being opened. Later ones are dropped.
+	udpPendingPackets = 16
+)
+
+// udpBufPool holds the buffers that packet conns read wrapped datagrams
+// into before copying out the payload, so that reads do not allocate.
+var udpBufPool = sync.Pool{New: func() any { return new([udpBufSize]byte) }}
+
+// udpSessionKey identifies a UDP flow by its 5-tuple; the protocol is
+// implicitly UDP.
+type udpSessionKey struct {
+	Src netip.AddrPort
+	Dst netip.AddrPort
+}
+
+// udpSession is a UDP flow and its upstream. conn, target and pending are
+// guarded by the mutex of the UDPNat.
+type udpSession struct {
+	conn       net.PacketConn // nil while the upstream is being opened
+	target     net.Addr       // where datagrams are sent: the destination, or its sniffed domain
+	pending    [][]byte       // datagrams to send once the upstream is open
+	lastActive atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+// UDPNat keeps one upstream packet connection per UDP flow seen on the TUN
+// device and writes the replies back to the device as IP packets.
+type UDPNat struct {
+	ifce   TUNDevice
+	dialer Dialer
+	sniff  config.SniffConfig
+	fakeIP *FakeIPPool // nil unless in fake-IP mode
+
+	mu       sync.Mutex
+	sessions map[udpSessionKey]*udpSession
+	closed   bool
+}
+
+func NewUDPNat(ifce TUNDevice, dialer Dialer, sniff config.SniffConfig, fakeIP *FakeIPPool) *UDPNat {
+	return &UDPNat{
+		ifce:     ifce,
+		dialer:   dialer,
+		sniff:    sniff,
+		fakeIP:   fakeIP,
+		sessions: make(map[udpSessionKey]*udpSession),
+	}
+}
+
+// HandlePacket forwards a raw UDP packet read from the TUN device, opening a
+// new session for its flow if needed. Sessions are opened in the
+// background, since that may involve a handshake with the proxy server;
+// their first datagrams are queued meanwhile.
+func (n *UDPNat) HandlePacket(pkt []byte) error {
+	p, err := parseUDPPacket(pkt)
+	if err != nil {
+		return err
+	}
+	key := udpSessionKey{Src: p.Src, Dst: p.Dst}
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return net.ErrClosed
+	}
+	sess, ok := n.sessions[key]
+	if !ok {
+		sess = &udpSession{}
+		n.sessions[key] = sess
+	}
+	sess.touch()
+	conn, target := sess.conn, sess.target
+	if conn == nil {
+		if len(sess.pending) < udpPendingPackets {
+			sess.pending = append(sess.pending, bytes.Clone(p.Payload))
+		}
+		if !ok {
+			go n.open(key, sess, sess.pending[0])
+		}
+		n.mu.Unlock()
+		return nil
+	}
+	n.mu.Unlock()
+
+	if _, err := conn.WriteTo(p.Payload, target); err != nil {
+		return err
+	}
+	AddBytesSent(int64(len(p.Payload)))
+	return nil
+}
+
+// open opens the upstream of the new session sess, sniffed from first, its
+// first datagram. It sends the queued datagrams and then relays replies
+// until the session ends.
+func (n *UDPNat) open(key udpSessionKey, sess *udpSession, first []byte) {
+	conn, target, err := n.dial(key, first)
+	if err != nil {
+		log.Printf("UDP forwarding error: %v", err)
+		n.mu.Lock()
+		if n.sessions[key] == sess {
+			delete(n.sessions, key)
+		}
+		n.mu.Unlock()
+		return
+	}
+	// The queue is emptied before the session takes new datagrams directly,
+	// which keeps them in order.
+	for {
+		n.mu.Lock()
+		if n.closed || n.sessions[key] != sess {
+			n.mu.Unlock()
+			conn.Close()
+			return
+		}
+		pending := sess.pending
+		sess.pending = nil
+		if len(pending) == 0 {
+			sess.conn, sess.target = conn, target
+			n.mu.Unlock()
+			break
+		}
+		n.mu.Unlock()
+		for _, b := range pending {
+			if _, err := conn.WriteTo(b, target); err != nil {
+				log.Printf("UDP forwarding error: %v", err)
+				continue
+			}
+			AddBytesSent(int64(len(b)))
+		}
+	}
+	n.readLoop(key, sess)
+}
+
+// dial opens the upstream of the flow key, whose first datagram is payload,
+// and returns it with the address to send to.
+func (n *UDPNat) dial(key udpSessionKey, payload []byte) (net.PacketConn, net.Addr, error) {
+	ctx := withSource(context.Background(), key.Src.String())
+	var target net.Addr = net.UDPAddrFromAddrPort(key.Dst)
+	if n.fakeIP != nil && n.fakeIP.Contains(key.Dst.Addr()) {
+		addr, err := n.fakeIP.target(key.Dst)
+		if err != nil {
+			return nil, nil, err
+		}
+		target = packetAddr(addr)
+	}
+	var res sniffResult
+	if n.sniff.Enabled {
+		res = sniffPacket(payload)
+		ctx = withSniffed(ctx, res)
+		if n.sniff.Override && res.Domain != "" {
+			target = packetAddr(net.JoinHostPort(res.Domain, strconv.Itoa(int(key.Dst.Port()))))
+		}
+	}
+	if res.Protocol != "" {
+		log.Printf("TUN UDP %s -> %s (%s %s)", key.Src, key.Dst, res.Protocol, res.Domain)
+	} else {
+		log.Printf("TUN UDP %s -> %s", key.Src, key.Dst)
+	}
+	conn, err := n.dialer.ListenPacket(ctx, target.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, target, nil
+}
+
+// readLoop copies replies from the upstream back to the TUN device until the
+// session has been idle for udpSessionTimeout.
+func (n *UDPNat) readLoop(key udpSessionKey, sess *udpSession) {
+	defer n.remove(key, sess)
+
+	buf := make([]byte, udpBufSize)
+	for {
+		sess.conn.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		size, addr, err := sess.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && sess.idle() < udpSessionTimeout {
+				continue
+			}
+			return
+		}
+		sess.touch()
+		AddBytesReceived(int64(size))
+
+		// Replies appear to come from the address the application sent to,
+		// unless the upstream reports a different remote endpoint. Sessions
+		// dialed by sniffed domain or fake IP always use the original
+		// address, which is all the application knows.
+		src := key.Dst
+		_, byDomain := sess.target.(packetAddr)
+		if udpAddr, ok := addr.(*net.UDPAddr); ok && !byDomain {
+			ap := udpAddr.AddrPort()
+			if addr := ap.Addr().Unmap(); addr.Is4() == key.Dst.Addr().Is4() {
+				src = netip.AddrPortFrom(addr, ap.Port())
+			}
+		}
+		reply, err := buildUDPPacket(src, key.Src, buf[:size])
+		if err != nil {
+			log.Printf("Failed to build UDP reply: %v", err)
+			continue
+		}
+		if _, err := n.ifce.Write(reply); err != nil {
+			log.Printf("Failed to write UDP reply to TUN: %v", err)
+			return
+		}
+	}
+}
+
+func (n *UDPNat) remove(key udpSessionKey, sess *udpSession) {
+	n.mu.Lock()
+	if n.sessions[key] == sess {
+		delete(n.sessions, key)
+	}
+	n.mu.Unlock()
+	sess.conn.Close()
+}
+
+// Close releases every open session.
+func (n *UDPNat) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.closed = true
+	for key, sess := range n.sessions {
+		// Sessions still being opened close their upstream themselves.
+		if sess.conn != nil {
+			sess.conn.Close()
+		}
+		delete(n.sessions, key)
+	}
+}
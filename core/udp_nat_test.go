@@ -0,0 +1,101 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/amirhosseinghanipour/nekogo/config"
+)
+
+// slowDialer opens UDP sessions only once release is closed.
+type slowDialer struct {
+	release chan struct{}
+}
+
+func (d *slowDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (d *slowDialer) ListenPacket(ctx context.Context, addr string) (net.PacketConn, error) {
+	<-d.release
+	return net.ListenPacket("udp", "127.0.0.1:0")
+}
+
+// testTUN is a TUNDevice that hands the packets written to it to a channel.
+type testTUN struct {
+	written chan []byte
+}
+
+func (t *testTUN) Name() string             { return "test" }
+func (t *testTUN) Read([]byte) (int, error) { return 0, net.ErrClosed }
+func (t *testTUN) Close() error             { return nil }
+func (t *testTUN) Write(b []byte) (int, error) {
+	t.written <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// TestUDPNatOpensInBackground checks that a session whose upstream is slow
+// to open does not hold up the packets handed to the NAT, and that its
+// first datagrams are sent in order once it is open.
+func TestUDPNatOpensInBackground(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	dialer := &slowDialer{release: make(chan struct{})}
+	tun := &testTUN{written: make(chan []byte, 1)}
+	nat := NewUDPNat(tun, dialer, config.SniffConfig{}, nil)
+	defer nat.Close()
+
+	src := netip.MustParseAddrPort("10.0.85.2:40000")
+	dst := upstream.LocalAddr().(*net.UDPAddr).AddrPort()
+	start := time.Now()
+	for _, payload := range []string{"one", "two", "three"} {
+		pkt, err := buildUDPPacket(src, dst, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nat.HandlePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("HandlePacket waited %v for the upstream", d)
+	}
+	close(dialer.release)
+
+	upstream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	var from net.Addr
+	for _, want := range []string{"one", "two", "three"} {
+		n, addr, err := upstream.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Errorf("upstream got %q, want %q", buf[:n], want)
+		}
+		from = addr
+	}
+
+	if _, err := upstream.WriteTo([]byte("reply"), from); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pkt := <-tun.written:
+		p, err := parseUDPPacket(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Src != dst || p.Dst != src || string(p.Payload) != "reply" {
+			t.Errorf("reply %v -> %v %q, want %v -> %v %q", p.Src, p.Dst, p.Payload, dst, src, "reply")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply written to the TUN device")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"image/color"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -43,6 +44,7 @@ func (b *BlackTheme) Size(n fyne.ThemeSizeName) float32       { return theme.Def
 var (
 	cfg      *config.AppConfig
 	stopChan chan struct{}
+	done     chan struct{} // closed once the running session has stopped
 	mu       sync.Mutex
 )
 
@@ -67,11 +69,28 @@ func RunGUI() {
 		},
 		func(i widget.ListItemID, o fyne.CanvasObject) {
 			c := o.(*fyne.Container)
-			c.Objects[0].(*widget.Label).SetText(cfg.Servers[i].Name)
+			c.Objects[0].(*widget.Label).SetText(serverLabel(i))
 			c.Objects[1].(*widget.Label).SetText(cfg.Servers[i].Latency)
 		},
 	)
 
+	groupList := widget.NewList(
+		func() int { return len(cfg.Groups) },
+		func() fyne.CanvasObject {
+			return container.NewHBox(widget.NewLabel("Group Name"), widget.NewLabel("Member"))
+		},
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			c := o.(*fyne.Container)
+			g := cfg.Groups[i]
+			name := fmt.Sprintf("%s (%s)", g.Name, g.Type)
+			if g.Name == cfg.ActiveGroup {
+				name += " [active]"
+			}
+			c.Objects[0].(*widget.Label).SetText(name)
+			c.Objects[1].(*widget.Label).SetText(groupMemberLabel(g))
+		},
+	)
+
 	startStopBtn := widget.NewButton("Start", nil)
 	startStopBtn.Importance = widget.HighImportance
 
@@ -91,7 +110,7 @@ func RunGUI() {
 		widget.NewToolbarAction(theme.MediaPlayIcon(), func() { // Test Latency
 			for i := range cfg.Servers {
 				go func(index int) {
-					latency, err := core.TestServerLatency(cfg.Servers[index])
+					latency, err := core.TestServerLatency(cfg, index)
 					mu.Lock()
 					if err != nil {
 						cfg.Servers[index].Latency = "Timeout"
@@ -120,7 +139,10 @@ func RunGUI() {
 	content := container.NewBorder(
 		topBox,
 		container.NewVBox(statsLabel, widget.NewSeparator(), rulesLabel), nil, nil,
-		serverList,
+		container.NewAppTabs(
+			container.NewTabItem("Servers", serverList),
+			container.NewTabItem("Groups", groupList),
+		),
 	)
 
 	startStopBtn.OnTapped = func() {
@@ -135,15 +157,19 @@ func RunGUI() {
 				return
 			}
 			stopChan = make(chan struct{})
-			go func() {
+			done = make(chan struct{})
+			go func(stop, done chan struct{}) {
+				defer close(done)
 				statusLabel.SetText("Status: Running...")
 				var err error
 				if cfg.Mode == "tun" {
-					err = core.StartTUNWithConfig(cfg, stopChan)
+					err = core.StartTUNWithConfig(cfg, stop)
 				} else if cfg.Mode == "proxy" {
-					activeServer := cfg.Servers[cfg.ActiveIndex]
-					proxyAddr := fmt.Sprintf("%s:%d", activeServer.Address, activeServer.Port)
-					err = core.StartProxy(activeServer.Type, proxyAddr)
+					var proxy *core.Proxy
+					if proxy, err = core.StartProxy(cfg); err == nil {
+						<-stop
+						err = proxy.Stop()
+					}
 				} else {
 					err = fmt.Errorf("unsupported mode: %s", cfg.Mode)
 				}
@@ -153,14 +179,21 @@ func RunGUI() {
 				} else {
 					statusLabel.SetText("Status: Idle")
 				}
-			}()
+			}(stopChan, done)
 			startStopBtn.SetText("Stop")
 		}
 	}
 
 	serverList.OnSelected = func(id widget.ListItemID) {
 		cfg.ActiveIndex = id
+		cfg.ActiveGroup = ""
 		config.SaveConfig("nekogo.yaml", cfg)
+		groupList.Refresh()
+	}
+
+	groupList.OnSelected = func(id widget.ListItemID) {
+		groupList.Unselect(id)
+		showGroupDialog(id, w, groupList)
 	}
 
 	w.Canvas().AddShortcut(&fyne.ShortcutPaste{}, func(shortcut fyne.Shortcut) {
@@ -177,6 +210,7 @@ func RunGUI() {
 			fyne.NewMenuItem("Quit", func() { a.Quit() }),
 		),
 		fyne.NewMenu("Edit",
+			fyne.NewMenuItem("TUN Settings", func() { showTUNDialog(w) }),
 			fyne.NewMenuItem("Import from Clipboard", func() {
 				importFromClipboard(w.Clipboard().Content(), w, serverList)
 			}),
@@ -225,6 +259,171 @@ func RunGUI() {
 
 	w.SetContent(content)
 	w.ShowAndRun()
+
+	// A running session is stopped before exiting so that TUN mode removes
+	// its routing.
+	if stopChan != nil {
+		close(stopChan)
+		<-done
+	}
+}
+
+// groupMemberLabel describes the member a group uses. While running, this
+// is the running group's current choice.
+func groupMemberLabel(g config.GroupConfig) string {
+	if rg, ok := core.RunningGroup(g.Name); ok {
+		if now := rg.Now(); now != "" {
+			return now
+		}
+	}
+	switch g.Type {
+	case "selector":
+		if g.Selected != "" {
+			return g.Selected
+		}
+		return g.Members[0]
+	case "load-balance":
+		return fmt.Sprintf("%d members", len(g.Members))
+	default:
+		return "auto"
+	}
+}
+
+// showGroupDialog lets the user make cfg.Groups[i] the active group and,
+// for selectors, choose its member. Changes apply to a running session
+// right away.
+func showGroupDialog(i int, w fyne.Window, groupList *widget.List) {
+	g := cfg.Groups[i]
+	save := func() {
+		if err := config.SaveConfig("nekogo.yaml", cfg); err != nil {
+			dialog.ShowError(fmt.Errorf("failed to save config: %w", err), w)
+		}
+		groupList.Refresh()
+	}
+
+	// Callbacks are set after the initial state so that it is not saved.
+	active := widget.NewCheck("Use this group instead of the active server", nil)
+	active.SetChecked(cfg.ActiveGroup == g.Name)
+	active.OnChanged = func(on bool) {
+		if on {
+			cfg.ActiveGroup = g.Name
+		} else if cfg.ActiveGroup == g.Name {
+			cfg.ActiveGroup = ""
+		}
+		save()
+	}
+	items := []fyne.CanvasObject{
+		widget.NewLabel(fmt.Sprintf("Type: %s", g.Type)),
+		widget.NewLabel("Members: " + strings.Join(g.Members, ", ")),
+		active,
+	}
+
+	if g.Type == "selector" {
+		member := widget.NewSelect(g.Members, nil)
+		member.SetSelected(groupMemberLabel(g))
+		member.OnChanged = func(name string) {
+			cfg.Groups[i].Selected = name
+			if err := core.SelectGroupMember(g.Name, name); err != nil {
+				dialog.ShowError(err, w)
+			}
+			save()
+		}
+		items = append(items, widget.NewLabel("Selected member:"), member)
+	}
+	dialog.ShowCustom(g.Name, "Close", container.NewVBox(items...), w)
+}
+
+// showTUNDialog edits cfg.TUN. Changes apply the next time TUN mode is
+// started.
+func showTUNDialog(w fyne.Window) {
+	t := cfg.TUN
+	entry := func(value, placeholder string) *widget.Entry {
+		e := widget.NewEntry()
+		e.SetText(value)
+		e.SetPlaceHolder(placeholder)
+		return e
+	}
+	routes := func(values []string) *widget.Entry {
+		e := widget.NewMultiLineEntry()
+		e.SetText(strings.Join(values, "\n"))
+		e.SetPlaceHolder("One CIDR per line")
+		return e
+	}
+	mtu := ""
+	if t.MTU != 0 {
+		mtu = strconv.Itoa(t.MTU)
+	}
+	name := entry(t.Name, config.DefaultTUNName)
+	address := entry(t.Address, config.DefaultTUNAddress)
+	address6 := entry(t.Address6, config.DefaultTUNAddress6)
+	mtuEntry := entry(mtu, strconv.Itoa(config.DefaultTUNMTU))
+	autoRoute := widget.NewCheck("Route traffic into the device", nil)
+	autoRoute.SetChecked(t.AutoRouteEnabled())
+	strictRoute := widget.NewCheck("Route the LAN into the device too", nil)
+	strictRoute.SetChecked(t.StrictRoute)
+	include := routes(t.IncludeRoutes)
+	exclude := routes(t.ExcludeRoutes)
+	dns := entry(t.DNS, "DNS listener or 8.8.8.8")
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("Device name", name),
+		widget.NewFormItem("IPv4 address", address),
+		{Text: "IPv6 address", Widget: address6, HintText: `"none" turns IPv6 off`},
+		widget.NewFormItem("MTU", mtuEntry),
+		widget.NewFormItem("Auto route", autoRoute),
+		widget.NewFormItem("Strict route", strictRoute),
+		widget.NewFormItem("Include routes", include),
+		widget.NewFormItem("Exclude routes", exclude),
+		widget.NewFormItem("DNS (Windows)", dns),
+	}
+	dialog.ShowForm("TUN Settings", "Save", "Cancel", items, func(ok bool) {
+		if !ok {
+			return
+		}
+		updated := config.TUNConfig{
+			Name:          strings.TrimSpace(name.Text),
+			Address:       strings.TrimSpace(address.Text),
+			Address6:      strings.TrimSpace(address6.Text),
+			StrictRoute:   strictRoute.Checked,
+			IncludeRoutes: strings.Fields(include.Text),
+			ExcludeRoutes: strings.Fields(exclude.Text),
+			DNS:           strings.TrimSpace(dns.Text),
+		}
+		if !autoRoute.Checked {
+			off := false
+			updated.AutoRoute = &off
+		}
+		if text := strings.TrimSpace(mtuEntry.Text); text != "" {
+			n, err := strconv.Atoi(text)
+			if err != nil {
+				dialog.ShowError(fmt.Errorf("invalid MTU: %s", text), w)
+				return
+			}
+			updated.MTU = n
+		}
+		if err := updated.Validate(); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		cfg.TUN = updated
+		if err := config.SaveConfig("nekogo.yaml", cfg); err != nil {
+			dialog.ShowError(fmt.Errorf("failed to save config: %w", err), w)
+		}
+	}, w)
+}
+
+// serverLabel names cfg.Servers[i] in the server list. Servers reached
+// through detours are shown with their chain, starting at the first hop.
+func serverLabel(i int) string {
+	chain, err := cfg.DetourChain(i)
+	if err != nil {
+		return fmt.Sprintf("%s (%v)", cfg.Servers[i].Name, err)
+	}
+	names := make([]string, len(chain))
+	for j, s := range chain {
+		names[len(chain)-1-j] = s.Name
+	}
+	return strings.Join(names, " → ")
 }
 
 func importFromClipboard(content string, w fyne.Window, serverList *widget.List) {